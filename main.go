@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"log"
 	"net/http"
 	h "southwinds.dev/http"
 	"southwinds.dev/source/service"
@@ -29,23 +30,42 @@ func main() {
 ++++++++| configuration service |+++++++++
 %s
 `, service.Version)
+	if err := service.Init(); err != nil {
+		log.Fatalf("cannot initialise source: %s", err)
+	}
 	server := h.New("SOURCE", service.Version)
 	server.Http = func(router *mux.Router) {
 		// enables basic authentication
 		router.Use(server.AuthenticationMiddleware)
+		router.Use(service.RevealMiddleware)
 		router.HandleFunc("/ready", service.ReadyHandler).Methods(http.MethodGet)
 		// validation
 		router.HandleFunc("/type", service.SetTypeHandler).Methods(http.MethodPut)
 		router.HandleFunc("/type/{key}", service.GetTypeHandler).Methods(http.MethodGet)
+		router.HandleFunc("/type/{key}/version", service.GetTypeVersionsHandler).Methods(http.MethodGet)
+		router.HandleFunc("/type/{key}/version/{version}", service.GetTypeVersionHandler).Methods(http.MethodGet)
+		router.HandleFunc("/type/{key}/validate-items", service.ValidateTypeItemsHandler).Methods(http.MethodPost)
 		router.HandleFunc("/type", service.GetTypesHandler).Methods(http.MethodGet)
 		router.HandleFunc("/type/{key}", service.DeleteTypeHandler).Methods(http.MethodDelete)
+		router.HandleFunc("/type/{key}/retention/{count}", service.SetTypeRetentionHandler).Methods(http.MethodPut)
+		router.HandleFunc("/type/{key}/index", service.SetTypeIndexHandler).Methods(http.MethodPut)
+		router.HandleFunc("/type/{key}/index", service.GetTypeIndexHandler).Methods(http.MethodGet)
 		// configurations
 		router.HandleFunc("/item/{key}", service.SetItemHandler).Methods(http.MethodPut)
+		router.HandleFunc("/item/{key}", service.PatchItemHandler).Methods(http.MethodPatch)
 		router.HandleFunc("/item/{key}", service.GetItemHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item", service.GetItemsHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item/{key}", service.DeleteItemHandler).Methods(http.MethodDelete)
+		router.HandleFunc("/item/{key}/value/{pointer:.*}", service.GetItemValueHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item/{key}/children", service.GetChildrenHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item/{key}/parents", service.GetParentsHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/descendants", service.GetDescendantsHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/ancestors", service.GetAncestorsHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/impact", service.GetImpactHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/effective", service.GetEffectiveHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/history", service.GetItemHistoryHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/revision/{revision}", service.GetItemRevisionHandler).Methods(http.MethodGet)
+		router.HandleFunc("/item/{key}/rollback/{revision}", service.RollbackItemHandler).Methods(http.MethodPost)
 		router.HandleFunc("/item/tag/{tags}", service.GetTaggedItemsHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item/type/{type}", service.GetItemsByTypeHandler).Methods(http.MethodGet)
 		router.HandleFunc("/item/pop/oldest/{type}", service.PopOldestByTypeHandler).Methods(http.MethodDelete)
@@ -61,7 +81,14 @@ func main() {
 		router.HandleFunc("/link/{from-key}/to/{to-key}", service.LinkHandler).Methods(http.MethodPut)
 		router.HandleFunc("/link/{from-key}/to/{to-key}", service.UnlinkHandler).Methods(http.MethodDelete)
 		router.HandleFunc("/link", service.GetLinksHandler).Methods(http.MethodGet)
+		router.HandleFunc("/link/graph", service.ExportGraphHandler).Methods(http.MethodGet)
 		router.HandleFunc("/link", service.DeleteLinksHandler).Methods(http.MethodDelete)
+		// administration
+		router.HandleFunc("/admin/schema", service.AdminSchemaHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/keys/rotation", service.AdminRotateKeysHandler).Methods(http.MethodPost)
+		router.HandleFunc("/admin/keys/rotation", service.AdminKeyRotationHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/shred/item/{key}", service.AdminShredItemHandler).Methods(http.MethodPost)
+		router.HandleFunc("/admin/shred/type/{type}", service.AdminShredTypeHandler).Methods(http.MethodPost)
 	}
 	server.Serve()
 }
@@ -10,21 +10,15 @@ package service
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/invopop/jsonschema"
-	schemaValidation "github.com/qri-io/jsonschema"
-	"io"
-	"log"
 	_ "modernc.org/sqlite"
-	"os"
 	"path/filepath"
+	"sort"
 	"southwinds.dev/source_client"
 	"strings"
 	"time"
@@ -38,11 +32,26 @@ var (
 	ErrNotFound         = errors.New("item not found")
 	ErrInvalidItemValue = errors.New("invalid item value, schema verification failed")
 	ErrItemTypeNotFound = errors.New("item type not found")
+	ErrVersionMismatch  = errors.New("item version does not match the expected version")
+	ErrItemLinked       = errors.New("item is linked from other items")
 )
 
+// deleteOptions how the items linked to a deleted item are handled
+type deleteOptions struct {
+	// cascade also deletes the descendants of the item, following links from parents to children
+	cascade bool
+	// restrict refuses to delete items linked from items that are not deleted with ErrItemLinked
+	restrict bool
+}
+
+// anyVersion an expected item version that matches any existing version of an item, but not a missing item
+const anyVersion int64 = -1
+
 // DataBase the definition of the configuration database
 type DataBase struct {
-	db *sql.DB
+	db *sqlDB
+	// rotation the progress of the last encryption key rotation
+	rotation rotationTracker
 }
 
 // newDb create a new configuration database on the specified path
@@ -56,14 +65,66 @@ func newDb(path string) (*DataBase, error) {
 }
 
 // setTypeFromString set the json schema for an item type using a json string representation of the schema
+// a new version of the type is recorded when its schema changes, otherwise the prototype of the current version is
+// updated in place
 func (d *DataBase) setTypeFromString(key string, schema, proto []byte) error {
-	stmt := `INSERT INTO type(key, schema, proto) VALUES(?, ?, ?) ON CONFLICT(key) DO UPDATE SET schema = excluded.schema, proto = excluded.proto;`
-	statement, err := d.db.Prepare(stmt)
+	return d.setCheckedType(key, schema, proto, nil)
+}
+
+// setCheckedType set the json schema for an item type as setTypeFromString, if a check of the current schema passes
+// the type is locked before the check so that the schema cannot change until it is set
+func (d *DataBase) setCheckedType(key string, schema, proto []byte, check func(current []byte) error) error {
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(key, schema, proto)
-	return err
+	var (
+		current   int64
+		oldSchema []byte
+	)
+	err = tx.QueryRowContext(ctx, `SELECT version, schema FROM type WHERE key = ?`+tx.dialect.forUpdate+`;`, key).Scan(&current, &oldSchema)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return err
+	}
+	exists := err == nil
+	if check != nil {
+		if err = check(oldSchema); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if exists && sameSchema(oldSchema, schema) {
+		if _, err = tx.ExecContext(ctx, `UPDATE type SET proto = ? WHERE key = ?;`, proto, key); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, `UPDATE type_version SET proto = ? WHERE type_key = ? AND version = ?;`, proto, key, current); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	// versions continue from those of a type deleted and set again
+	var version int64
+	if err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM type_version WHERE type_key = ?;`, key).Scan(&version); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO type_version(type_key, version, schema, proto, created) VALUES(?, ?, ?, ?, ?);`, key, version, schema, proto, time.Now().UTC().UnixNano()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `INSERT INTO type(key, schema, proto, version) VALUES(?, ?, ?, ?) ON CONFLICT(key) DO UPDATE SET schema = excluded.schema, proto = excluded.proto, version = excluded.version;`, key, schema, proto, version); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = unindexSecrets(ctx, tx, key, schema); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("cannot remove secret fields from the index of type %s: %s", key, err)
+	}
+	return tx.Commit()
 }
 
 // setTypeFromStruct set the json schema for the item type by inferring it from the passed in object
@@ -82,95 +143,194 @@ func (d *DataBase) setTypeFromStruct(key string, obj interface{}) error {
 	return d.setTypeFromString(key, schema, proto)
 }
 
-// DeleteType delete a json schema for an item type
+// DeleteType delete a json schema for an item type along with the indexed fields of its items
 // Can be done with existing items, as a result items of the missing type are not validated
 func (d *DataBase) DeleteType(key string) error {
-	stmt := `DELETE FROM type WHERE key=?; `
-	statement, err := d.db.Prepare(stmt)
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(key)
-	return err
+	if _, err = tx.ExecContext(ctx, `DELETE FROM item_field WHERE item_key IN (SELECT key FROM item WHERE type = ?);`, key); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM type WHERE key = ?;`, key); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 // SetItem set the value of an item
-func (d *DataBase) SetItem(key, iType string, value interface{}) (error, bool) {
-	if value == nil {
-		return fmt.Errorf("value not provided"), false
-	}
-	var typeInfo *src.TT
-	var err error
-	if len(iType) > 0 {
-		// get the schema for the type
-		typeInfo, err = d.getTypeInfo(iType)
-		if err != nil {
-			if err == ErrItemTypeNotFound {
-				return err, false
-			} else {
-				return fmt.Errorf("error retrieving type definition for %s: %s", key, err), false
-			}
-		}
-	}
-	if sv, ok := value.(string); ok {
-		return d.setItemString(key, sv, typeInfo)
-	}
-	valueBytes, err := json.Marshal(value)
+// if version is greater than zero, the item is only updated if its current version matches it (compare-and-swap),
+// otherwise ErrVersionMismatch is returned; anyVersion requires the item to exist and zero sets the item unconditionally
+func (d *DataBase) SetItem(key, iType string, value interface{}, version int64) (error, bool) {
+	sv, typeInfo, err, isValidationError := prepareItem(d, key, iType, value)
 	if err != nil {
-		return err, false
+		return err, isValidationError
 	}
-	return d.setItemString(key, string(valueBytes[:]), typeInfo)
+	return d.setItemString(key, sv, typeInfo, version)
 }
 
-// DeleteItem delete the specified item
-func (d *DataBase) DeleteItem(key string) error {
-	// delete the item
-	stmt := `DELETE FROM item WHERE key=?; `
-	statement, err := d.db.Prepare(stmt)
+// DeleteItem delete the specified item along with its tags, links, revisions and data key in a single transaction
+// if version is greater than zero, the item is only deleted if its current version matches it, anyVersion requires
+// the item to exist and zero deletes the item unconditionally
+func (d *DataBase) DeleteItem(key string, version int64, opts deleteOptions) error {
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(key)
+	var current int64
+	if err = tx.QueryRowContext(ctx, `SELECT version FROM item WHERE key=?`+tx.dialect.forUpdate+`;`, key).Scan(&current); err != nil {
+		_ = tx.Rollback()
+		if err != sql.ErrNoRows {
+			return err
+		}
+		// a missing item does not satisfy any expected version
+		if version != 0 {
+			return ErrVersionMismatch
+		}
+		return nil
+	}
+	if version > 0 && current != version {
+		_ = tx.Rollback()
+		return ErrVersionMismatch
+	}
+	// the items to delete along with their types
+	query, args := `SELECT key, type FROM item WHERE key=?`, []interface{}{key}
+	if opts.cascade {
+		// the items referenced are not children, they can be shared with other items
+		var cte string
+		cte, args = reachCTE(key, false, 0, linkKinds{except: refRel})
+		query = cte + `SELECT key, type FROM item WHERE key IN (SELECT key FROM reach)`
+	}
+	deleted, err := queryItemTypes(ctx, tx, query+tx.dialect.forUpdate+`;`, args...)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
-	// delete any associations
-	statement, err = d.db.Prepare("DELETE FROM link WHERE from_key=? OR to_key=?;")
+	if opts.restrict {
+		if err = checkUnlinked(ctx, tx, deleted); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	for k, iType := range deleted {
+		if err = shredItemTx(ctx, tx, k, iType); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// queryItemTypes get the types of the items selected by a query, by item key
+func queryItemTypes(ctx context.Context, tx *sqlTx, query string, args ...interface{}) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(rows)
+	types := map[string]string{}
+	for rows.Next() {
+		var key, iType string
+		if err = rows.Scan(&key, &iType); err != nil {
+			return nil, err
+		}
+		types[key] = iType
+	}
+	return types, rows.Err()
+}
+
+// checkUnlinked returns ErrItemLinked if any of the items is linked from an item not in the set
+func checkUnlinked(ctx context.Context, tx *sqlTx, items map[string]string) error {
+	var (
+		keys []string
+		args []interface{}
+	)
+	for key := range items {
+		keys = append(keys, "?")
+		args = append(args, key)
 	}
-	_, err = statement.Exec(key, key)
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT from_key, to_key FROM link WHERE to_key IN (`+strings.Join(keys, ", ")+`);`, args...)
 	if err != nil {
 		return err
 	}
-	// delete any tags
-	statement, err = d.db.Prepare("DELETE FROM tag WHERE item_key=?;")
-	if err != nil {
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(rows)
+	var linked []Link
+	for rows.Next() {
+		var l Link
+		if err = rows.Scan(&l.From, &l.To); err != nil {
+			return err
+		}
+		if _, deleted := items[l.From]; !deleted {
+			linked = append(linked, l)
+		}
+	}
+	if err = rows.Err(); err != nil {
 		return err
 	}
-	_, err = statement.Exec(key)
-	return err
+	return linkedError(linked)
 }
 
-// Link add an association between two items
-func (d *DataBase) Link(from, to string) error {
-	stmt := `INSERT INTO link(from_key, to_key) VALUES(?, ?); `
-	statement, err := d.db.Prepare(stmt)
-	if err != nil {
-		return err
+// linkedError an ErrItemLinked error listing the links preventing a deletion, nil if there are none
+func linkedError(links []Link) error {
+	if len(links) == 0 {
+		return nil
 	}
-	_, err = statement.Exec(from, to)
-	return err
+	sort.Slice(links, sortLinks(links))
+	var s []string
+	for _, l := range links {
+		s = append(s, fmt.Sprintf("'%s' from '%s'", l.To, l.From))
+	}
+	return fmt.Errorf("%w: %s", ErrItemLinked, strings.Join(s, ", "))
 }
 
-// unLink remove an association between two items
-func (d *DataBase) unLink(from, to string) error {
-	stmt := `DELETE FROM link WHERE from_key=? AND to_key=?; `
-	statement, err := d.db.Prepare(stmt)
+// Link add an association of a kind between two items, or replace its attributes if it exists
+// returns ErrNotFound if either item does not exist
+func (d *DataBase) Link(from, to, rel string, attributes json.RawMessage) error {
+	var attrs sql.NullString
+	if len(attributes) > 0 {
+		attrs = sql.NullString{String: string(attributes), Valid: true}
+	}
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = statement.Exec(from, to)
+	// the items cannot be deleted until the link is created
+	for _, key := range []string{from, to} {
+		var found int
+		if err = tx.QueryRowContext(ctx, `SELECT 1 FROM item WHERE key=?`+tx.dialect.forShare+`;`, key).Scan(&found); err != nil {
+			_ = tx.Rollback()
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("cannot link '%s': %w", key, ErrNotFound)
+			}
+			return err
+		}
+	}
+	stmt := `INSERT INTO link(from_key, to_key, rel, attributes) VALUES(?, ?, ?, ?) ON CONFLICT(from_key, to_key, rel) DO UPDATE SET attributes = excluded.attributes;`
+	if _, err = tx.ExecContext(ctx, stmt, from, to, rel, attrs); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// unLink remove an association of a kind between two items, or all their associations if no kind is specified
+func (d *DataBase) unLink(from, to, rel string) error {
+	stmt := `DELETE FROM link WHERE from_key=? AND to_key=? AND (CAST(? AS TEXT) = '' OR rel=?); `
+	_, err := d.db.Exec(stmt, from, to, rel, rel)
 	return err
 }
 
@@ -182,65 +342,88 @@ func (d *DataBase) tag(key, name string) error {
 // tagValue tag an item with a name and a value
 func (d *DataBase) tagValue(key, name, value string) error {
 	stmt := `INSERT INTO tag(item_key, name, value) VALUES(?, ?, ?) ON CONFLICT(item_key, name) DO UPDATE SET value = excluded.value;`
-	statement, err := d.db.Prepare(stmt)
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec(key, name, value)
+	_, err := d.db.Exec(stmt, key, name, value)
 	return err
 }
 
 // untag a configuration
 func (d *DataBase) untag(key string, name string) error {
 	stmt := `DELETE FROM tag WHERE item_key=? AND name=?; `
-	statement, err := d.db.Prepare(stmt)
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec(key, name)
+	_, err := d.db.Exec(stmt, key, name)
 	return err
 }
 
-func (d *DataBase) deleteLinks() interface{} {
+func (d *DataBase) deleteLinks() error {
 	stmt := `DELETE FROM link;`
-	statement, err := d.db.Prepare(stmt)
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec()
+	_, err := d.db.Exec(stmt)
 	return err
 }
 
 // getItem get an item by key
 func (d *DataBase) getItem(key string) (*src.I, error) {
-	row := d.db.QueryRow(`SELECT type, value, updated FROM item WHERE key=?;`, key)
+	item, _, err := d.getVersionedItem(key)
+	return item, err
+}
+
+// getVersionedItem get an item by key along with its current version
+func (d *DataBase) getVersionedItem(key string) (*src.I, int64, error) {
+	row := d.db.QueryRow(`SELECT i.type, i.value, i.updated, i.version, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE i.key=?;`, key)
 	var (
 		itype   string
 		value   []byte
 		updated sql.NullInt64
+		version int64
+		wrapped []byte
 	)
-	err := row.Scan(&itype, &value, &updated)
+	err := row.Scan(&itype, &value, &updated, &version, &wrapped)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows") {
-			return nil, ErrNotFound
+			return nil, 0, ErrNotFound
 		}
-		return nil, err
+		return nil, 0, err
 	}
-	vv, decErr := decrypt(value)
-	if decErr != nil {
-		return nil, err
+	vv, err := openValue(key, itype, wrapped, value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 	}
 	return &src.I{
 		Key:     key,
 		Type:    itype,
 		Value:   vv,
 		Updated: time.Unix(0, updated.Int64).UTC(),
-	}, nil
+	}, version, nil
+}
+
+// getItemTypeVersions get the version of the type schema the items of a type were last validated against, by key,
+// items validated before versions were recorded are left out
+func (d *DataBase) getItemTypeVersions(t string) (map[string]int64, error) {
+	row, err := d.db.Query(`SELECT key, type_version FROM item WHERE type = ? AND type_version IS NOT NULL;`, t)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	versions := map[string]int64{}
+	for row.Next() {
+		var (
+			key     string
+			version int64
+		)
+		if err = row.Scan(&key, &version); err != nil {
+			return nil, err
+		}
+		versions[key] = version
+	}
+	return versions, row.Err()
 }
 
 // getItemsByType get the  items with the specified type
 func (d *DataBase) getItemsByType(t string) ([]src.I, error) {
-	stmt := "SELECT DISTINCT i.key, i.type, i.value, i.updated FROM item i WHERE i.type=?"
+	stmt := "SELECT DISTINCT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE i.type=?"
 	row, err := d.db.Query(stmt, t)
 	if err != nil {
 		return nil, err
@@ -255,16 +438,17 @@ func (d *DataBase) getItemsByType(t string) ([]src.I, error) {
 		key, iType string
 		value      []byte
 		updated    sql.NullInt64
+		wrapped    []byte
 	)
 	var items []src.I
 	for row.Next() {
-		err = row.Scan(&key, &iType, &value, &updated)
+		err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 		if err != nil {
 			return nil, err
 		}
-		vv, decErr := decrypt(value)
-		if decErr != nil {
-			return nil, err
+		vv, err := openValue(key, iType, wrapped, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 		}
 		items = append(items, src.I{
 			Key:     key,
@@ -278,8 +462,27 @@ func (d *DataBase) getItemsByType(t string) ([]src.I, error) {
 
 // getTaggedItems get the items with the specified tag names
 func (d *DataBase) getTaggedItems(tags ...string) ([]src.I, error) {
-	stmt := "SELECT DISTINCT i.key, i.type, i.value, i.updated FROM item i INNER JOIN tag t ON i.key = t.item_key WHERE t.name" + toInSqlTags(tags)
-	row, err := d.db.Query(stmt)
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(tags))
+	for i, t := range tags {
+		args[i] = t
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(tags)), ", ")
+	return d.queryItems("SELECT DISTINCT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i INNER JOIN tag t ON i.key = t.item_key WHERE t.name IN ("+placeholders+");", args...)
+}
+
+// getItemsByTags get the items matching a tag expression
+func (d *DataBase) getItemsByTags(expr tagExpr) ([]src.I, error) {
+	var args []interface{}
+	where := expr.where(&args)
+	return d.queryItems("SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE "+where+" ORDER BY i.key;", args...)
+}
+
+// queryItems runs a query selecting the key, type, value, update time and wrapped data key of items and decrypts them
+func (d *DataBase) queryItems(query string, args ...interface{}) ([]src.I, error) {
+	row, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -293,16 +496,17 @@ func (d *DataBase) getTaggedItems(tags ...string) ([]src.I, error) {
 		key, iType string
 		value      []byte
 		updated    sql.NullInt64
+		wrapped    []byte
 	)
 	var items []src.I
 	for row.Next() {
-		err = row.Scan(&key, &iType, &value, &updated)
+		err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 		if err != nil {
 			return nil, err
 		}
-		vv, decErr := decrypt(value)
-		if decErr != nil {
-			return nil, err
+		vv, err := openValue(key, iType, wrapped, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 		}
 		items = append(items, src.I{
 			Key:     key,
@@ -311,7 +515,7 @@ func (d *DataBase) getTaggedItems(tags ...string) ([]src.I, error) {
 			Updated: time.Unix(0, updated.Int64).UTC(),
 		})
 	}
-	return items, nil
+	return items, row.Err()
 }
 
 // getTags get the tags (name & value) of an item
@@ -370,9 +574,9 @@ func (d *DataBase) getAllTags() ([]src.T, error) {
 	return tags, nil
 }
 
-// getChildren get the child items linked to a specified item
-func (d *DataBase) getChildren(parentKey string) ([]src.I, error) {
-	row, err := d.db.Query("SELECT i.key, i.type, i.value, i.updated FROM link l INNER JOIN item i ON l.to_key = i.key WHERE l.from_key=?;", parentKey)
+// getChildren get the child items linked to a specified item, optionally by links of a kind only
+func (d *DataBase) getChildren(parentKey, rel string) ([]src.I, error) {
+	row, err := d.db.Query("SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE EXISTS (SELECT 1 FROM link l WHERE l.to_key = i.key AND l.from_key=? AND (CAST(? AS TEXT) = '' OR l.rel=?));", parentKey, rel, rel)
 	if err != nil {
 		return nil, err
 	}
@@ -386,16 +590,17 @@ func (d *DataBase) getChildren(parentKey string) ([]src.I, error) {
 		key, iType string
 		value      []byte
 		updated    sql.NullInt64
+		wrapped    []byte
 	)
 	var items []src.I
 	for row.Next() {
-		err = row.Scan(&key, &iType, &value, &updated)
+		err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 		if err != nil {
 			return nil, err
 		}
-		vv, decErr := decrypt(value)
-		if decErr != nil {
-			return nil, err
+		vv, err := openValue(key, iType, wrapped, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 		}
 		items = append(items, src.I{
 			Key:     key,
@@ -407,9 +612,9 @@ func (d *DataBase) getChildren(parentKey string) ([]src.I, error) {
 	return items, nil
 }
 
-// getParents get the parent items linked to a specified item
-func (d *DataBase) getParents(childKey string) ([]src.I, error) {
-	row, err := d.db.Query("SELECT i.key, i.type, i.value, i.updated FROM link l INNER JOIN item i ON l.from_key = i.key where l.to_key=?;", childKey)
+// getParents get the parent items linked to a specified item, optionally by links of a kind only
+func (d *DataBase) getParents(childKey, rel string) ([]src.I, error) {
+	row, err := d.db.Query("SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE EXISTS (SELECT 1 FROM link l WHERE l.from_key = i.key AND l.to_key=? AND (CAST(? AS TEXT) = '' OR l.rel=?));", childKey, rel, rel)
 	if err != nil {
 		return nil, err
 	}
@@ -423,16 +628,17 @@ func (d *DataBase) getParents(childKey string) ([]src.I, error) {
 		key, iType string
 		value      []byte
 		updated    sql.NullInt64
+		wrapped    []byte
 	)
 	var items []src.I
 	for row.Next() {
-		err = row.Scan(&key, &iType, &value, &updated)
+		err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 		if err != nil {
 			return nil, err
 		}
-		vv, decErr := decrypt(value)
-		if decErr != nil {
-			return nil, err
+		vv, err := openValue(key, iType, wrapped, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 		}
 		items = append(items, src.I{
 			Key:     key,
@@ -445,7 +651,7 @@ func (d *DataBase) getParents(childKey string) ([]src.I, error) {
 }
 
 func (d *DataBase) getItems() ([]src.I, error) {
-	row, err := d.db.Query(`SELECT key, type, value, updated FROM item;`)
+	row, err := d.db.Query(`SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i;`)
 	if err != nil {
 		return nil, err
 	}
@@ -459,19 +665,20 @@ func (d *DataBase) getItems() ([]src.I, error) {
 		key, iType string
 		value      []byte
 		updated    sql.NullInt64
+		wrapped    []byte
 		items      []src.I
 	)
 	for row.Next() {
-		err = row.Scan(&key, &iType, &value, &updated)
+		err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 		if err != nil {
 			if strings.Contains(err.Error(), "no rows") {
 				return nil, ErrNotFound
 			}
 			return nil, err
 		}
-		vv, decErr := decrypt(value)
-		if decErr != nil {
-			return nil, decErr
+		vv, err := openValue(key, iType, wrapped, value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
 		}
 		items = append(items, src.I{
 			Key:     key,
@@ -483,8 +690,122 @@ func (d *DataBase) getItems() ([]src.I, error) {
 	return items, nil
 }
 
-func (d *DataBase) getLinks() ([]src.L, error) {
-	row, err := d.db.Query(`SELECT from_key, to_key FROM link;`)
+// getItemTypes get the type of all items by key without decrypting their values
+func (d *DataBase) getItemTypes() (map[string]string, error) {
+	row, err := d.db.Query(`SELECT key, type FROM item;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	types := map[string]string{}
+	for row.Next() {
+		var key, iType string
+		if err = row.Scan(&key, &iType); err != nil {
+			return nil, err
+		}
+		types[key] = iType
+	}
+	return types, row.Err()
+}
+
+// getItemStamp get the version and last update time of an item without decrypting its value
+func (d *DataBase) getItemStamp(key string) (int64, time.Time, error) {
+	var (
+		version int64
+		updated sql.NullInt64
+	)
+	err := d.db.QueryRow(`SELECT version, updated FROM item WHERE key=?;`, key).Scan(&version, &updated)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows") {
+			return 0, time.Time{}, ErrNotFound
+		}
+		return 0, time.Time{}, err
+	}
+	return version, time.Unix(0, updated.Int64).UTC(), nil
+}
+
+// getItemsStamp get an entity tag and the last modification time for all items without decrypting their values
+func (d *DataBase) getItemsStamp() (string, time.Time, error) {
+	return d.itemsStamp(`SELECT key, version, updated FROM item ORDER BY key;`,
+		`SELECT MAX(deleted) FROM item_deleted;`)
+}
+
+// getItemsByTypeStamp get an entity tag and the last modification time for the items of the specified type without
+// decrypting their values
+func (d *DataBase) getItemsByTypeStamp(t string) (string, time.Time, error) {
+	return d.itemsStamp(`SELECT key, version, updated FROM item WHERE type=? ORDER BY key;`,
+		`SELECT MAX(deleted) FROM item_deleted WHERE type=?;`, t)
+}
+
+// itemsStamp hashes the keys and versions of the items selected by a query and works out their last modification
+// time, including the time items were last removed from the selection
+func (d *DataBase) itemsStamp(query, deletedQuery string, args ...interface{}) (string, time.Time, error) {
+	row, err := d.db.Query(query, args...)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	var (
+		key      string
+		version  int64
+		updated  sql.NullInt64
+		modified int64
+	)
+	hash := sha256.New()
+	for row.Next() {
+		if err = row.Scan(&key, &version, &updated); err != nil {
+			return "", time.Time{}, err
+		}
+		_, _ = fmt.Fprintf(hash, "%s:%d\n", key, version)
+		if updated.Int64 > modified {
+			modified = updated.Int64
+		}
+	}
+	var deleted sql.NullInt64
+	if err = d.db.QueryRow(deletedQuery, args...).Scan(&deleted); err != nil {
+		return "", time.Time{}, err
+	}
+	if deleted.Int64 > modified {
+		modified = deleted.Int64
+	}
+	var lastModified time.Time
+	if modified > 0 {
+		lastModified = time.Unix(0, modified).UTC()
+	}
+	return stampETag(hash.Sum(nil)), lastModified, nil
+}
+
+// execer executes statements either directly on the database or within a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// recordLastVersion records the version of an item about to be deleted, from which its versions continue if the item
+// is created again, so that the entity tags of the deleted item never match the new one
+func recordLastVersion(ctx context.Context, e execer, key string) error {
+	_, err := e.ExecContext(ctx, `INSERT INTO item_last_version(key, version) SELECT key, version FROM item WHERE key = ? ON CONFLICT(key) DO UPDATE SET version = excluded.version;`, key)
+	return err
+}
+
+// recordDeletion records the time an item of the specified type was deleted, so that the last modification time of
+// item collections accounts for removed items
+func recordDeletion(ctx context.Context, e execer, iType string) error {
+	_, err := e.ExecContext(ctx, `INSERT INTO item_deleted(type, deleted) VALUES(?, ?) ON CONFLICT(type) DO UPDATE SET deleted = excluded.deleted;`, iType, time.Now().UTC().UnixNano())
+	return err
+}
+
+func (d *DataBase) getLinks(rel string) ([]Link, error) {
+	row, err := d.db.Query(`SELECT from_key, to_key, rel, attributes FROM link WHERE CAST(? AS TEXT) = '' OR rel = ? ORDER BY from_key, to_key, rel;`, rel, rel)
 	if err != nil {
 		return nil, err
 	}
@@ -495,21 +816,27 @@ func (d *DataBase) getLinks() ([]src.L, error) {
 		}
 	}(row)
 	var (
-		from, to string
-		links    []src.L
+		from, to, kind string
+		attributes     sql.NullString
+		links          []Link
 	)
 	for row.Next() {
-		err = row.Scan(&from, &to)
+		err = row.Scan(&from, &to, &kind, &attributes)
 		if err != nil {
 			if strings.Contains(err.Error(), "no rows") {
 				return nil, ErrNotFound
 			}
 			return nil, err
 		}
-		links = append(links, src.L{
+		l := Link{
 			From: from,
 			To:   to,
-		})
+			Rel:  kind,
+		}
+		if attributes.Valid {
+			l.Attributes = json.RawMessage(attributes.String)
+		}
+		links = append(links, l)
 	}
 	return links, nil
 }
@@ -545,6 +872,57 @@ func (d *DataBase) getTypes() ([]src.TT, error) {
 	return types, nil
 }
 
+// getTypeVersions get the versions of the schema of an item type, newest first, along with the number of items
+// validated against each version
+func (d *DataBase) getTypeVersions(key string) ([]TypeVersion, error) {
+	row, err := d.db.Query(`SELECT v.version, v.schema, v.proto, v.created, (SELECT COUNT(*) FROM item i WHERE i.type = v.type_key AND i.type_version = v.version) FROM type_version v WHERE v.type_key = ? ORDER BY v.version DESC;`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	var versions []TypeVersion
+	for row.Next() {
+		var (
+			v       = TypeVersion{Type: key}
+			created int64
+		)
+		if err = row.Scan(&v.Version, &v.Schema, &v.Proto, &created, &v.Items); err != nil {
+			return nil, err
+		}
+		v.Created = time.Unix(0, created).UTC()
+		versions = append(versions, v)
+	}
+	if err = row.Err(); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrItemTypeNotFound
+	}
+	return versions, nil
+}
+
+// getTypeVersion get a version of the schema of an item type
+func (d *DataBase) getTypeVersion(key string, version int64) (*TypeVersion, error) {
+	var (
+		v       = TypeVersion{Type: key, Version: version}
+		created int64
+	)
+	err := d.db.QueryRow(`SELECT v.schema, v.proto, v.created, (SELECT COUNT(*) FROM item i WHERE i.type = v.type_key AND i.type_version = v.version) FROM type_version v WHERE v.type_key = ? AND v.version = ?;`, key, version).Scan(&v.Schema, &v.Proto, &created, &v.Items)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	v.Created = time.Unix(0, created).UTC()
+	return &v, nil
+}
+
 func (d *DataBase) getTypeInfo(key string) (*src.TT, error) {
 	row := d.db.QueryRow(`SELECT schema, proto FROM type WHERE key = ?;`, key)
 	var schema, proto []byte
@@ -558,90 +936,108 @@ func (d *DataBase) getTypeInfo(key string) (*src.TT, error) {
 	return &src.TT{Key: key, Schema: schema, Proto: proto}, nil
 }
 
-func (d *DataBase) setItemString(key, value string, iType *src.TT) (error, bool) {
-	// only performs validation if a type is specified
+// setItemString writes an item value that has already been validated against its type
+func (d *DataBase) setItemString(key, value string, iType *src.TT, version int64) (error, bool) {
+	typeKey := ""
 	if iType != nil {
-		ctx := context.Background()
-		rs := &schemaValidation.Schema{}
-		if err := json.Unmarshal(iType.Schema, rs); err != nil {
-			return fmt.Errorf("unmarshal schema: %s", err), false
-		}
-		// validate the value using the stored schema
-		errs, err := rs.ValidateBytes(ctx, []byte(value))
-		if err != nil {
-			return err, true
-		}
-		if len(errs) > 0 {
-			return errs[0], true
-		}
+		typeKey = iType.Key
 	}
-
-	stmt := `INSERT INTO item(key, type, value, updated) VALUES(?, ?, ?, ?) ON CONFLICT(key) DO UPDATE SET type = excluded.type, value = excluded.value, updated = excluded.updated;`
-	statement, err := d.db.Prepare(stmt)
+	updated := time.Now().UTC().UnixNano()
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err, false
 	}
-	vv, encErr := encrypt([]byte(value))
-	if encErr != nil {
-		return err, false
-	}
-	_, err = statement.Exec(key, iType.Key, vv, time.Now().UTC().UnixNano())
-	return err, false
-}
-
-func (d *DataBase) popOldestByType(itemType string) (*src.I, error) {
-	ctx := context.Background()
-	tx, err := d.db.BeginTx(ctx, nil)
+	dek, err := itemKey(ctx, tx, key)
 	if err != nil {
-		log.Fatal(err)
+		_ = tx.Rollback()
+		return fmt.Errorf("cannot get data key of item %s: %s", key, err), false
 	}
-	row := tx.QueryRow(`SELECT i.key, i.type, i.value, i.updated FROM item i WHERE i.type = ? ORDER BY updated ASC LIMIT 1;`, itemType)
-	var (
-		key     string
-		iType   string
-		value   []byte
-		updated sql.NullInt64
-	)
-	err = row.Scan(&key, &iType, &value, &updated)
+	vv, err := sealValue(dek, key, typeKey, []byte(value))
 	if err != nil {
 		_ = tx.Rollback()
-		if strings.Contains(err.Error(), "no rows") {
-			return nil, nil
+		return err, false
+	}
+	// the version of the type schema the value is validated against
+	var typeVersion sql.NullInt64
+	if iType != nil {
+		var schema []byte
+		if err = tx.QueryRowContext(ctx, `SELECT version, schema FROM type WHERE key = ?`+tx.dialect.forShare+`;`, typeKey).Scan(&typeVersion, &schema); err != nil {
+			_ = tx.Rollback()
+			if err == sql.ErrNoRows {
+				return ErrItemTypeNotFound, false
+			}
+			return err, false
+		}
+		// the schema could have changed since the value was validated
+		if !sameSchema(schema, iType.Schema) {
+			if err, isValidationError := validate(value, &src.TT{Key: typeKey, Schema: schema}); err != nil {
+				_ = tx.Rollback()
+				return err, isValidationError
+			}
 		}
-		return nil, err
 	}
-	_, err = tx.ExecContext(ctx, "DELETE FROM item WHERE item.key = ?", key)
-	if err != nil {
+	var row *sql.Row
+	switch {
+	case version > 0:
+		// compare-and-swap on the current version
+		row = tx.QueryRowContext(ctx, `UPDATE item SET type = ?, type_version = ?, value = ?, updated = ?, version = version + 1 WHERE key = ? AND version = ? RETURNING version;`, typeKey, typeVersion, vv, updated, key, version)
+	case version == anyVersion:
+		// update only if the item exists
+		row = tx.QueryRowContext(ctx, `UPDATE item SET type = ?, type_version = ?, value = ?, updated = ?, version = version + 1 WHERE key = ? RETURNING version;`, typeKey, typeVersion, vv, updated, key)
+	default:
+		// versions of an item created again continue from those of the deleted item
+		row = tx.QueryRowContext(ctx, `INSERT INTO item(key, type, type_version, value, updated, version) VALUES(?, ?, ?, ?, ?, (SELECT COALESCE(MAX(version), 0) + 1 FROM item_last_version WHERE key = ?)) ON CONFLICT(key) DO UPDATE SET type = excluded.type, type_version = excluded.type_version, value = excluded.value, updated = excluded.updated, version = item.version + 1 RETURNING version;`, key, typeKey, typeVersion, vv, updated, key)
+	}
+	var newVersion int64
+	if err = row.Scan(&newVersion); err != nil {
 		_ = tx.Rollback()
-		return nil, fmt.Errorf("cannot delete item %s: %s", key, err.Error())
+		if err == sql.ErrNoRows {
+			return ErrVersionMismatch, false
+		}
+		return err, false
 	}
-	err = tx.Commit()
-	vv, decErr := decrypt(value)
-	if decErr != nil {
-		return nil, err
+	// keeps the value as a new revision of the item
+	if err = addRevision(ctx, tx, key, typeKey, vv, updated, newVersion); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("cannot record revision of item %s: %s", key, err), false
 	}
-	return &src.I{
-		Key:     key,
-		Type:    iType,
-		Value:   vv,
-		Updated: time.Unix(0, updated.Int64).UTC(),
-	}, nil
+	if err = indexFields(ctx, tx, key, typeKey, []byte(value)); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("cannot index fields of item %s: %s", key, err), false
+	}
+	if err = linkReferences(ctx, tx, key, []byte(value)); err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("cannot link items referenced by item %s: %s", key, err), false
+	}
+	return tx.Commit(), false
+}
+
+func (d *DataBase) popOldestByType(itemType string) (*src.I, error) {
+	return d.pop(itemType, "ASC")
 }
 
 func (d *DataBase) popNewestByType(itemType string) (*src.I, error) {
+	return d.pop(itemType, "DESC")
+}
+
+// pop removes the item of a type that comes first when ordered by update time in the specified direction, along with
+// its data key, revisions, tags and links, as a delete does
+func (d *DataBase) pop(itemType, order string) (*src.I, error) {
 	ctx := context.Background()
 	tx, err := d.db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	row := tx.QueryRow(`SELECT i.key, i.type, i.value, i.updated FROM item i WHERE i.type = ? ORDER BY updated DESC LIMIT 1;`, itemType)
+	row := tx.QueryRow(`SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE i.type = ? ORDER BY updated `+order+` LIMIT 1`+d.db.dialect.skipLocked+`;`, itemType)
 	var (
 		key     string
 		iType   string
 		value   []byte
 		updated sql.NullInt64
+		wrapped []byte
 	)
-	err = row.Scan(&key, &iType, &value, &updated)
+	err = row.Scan(&key, &iType, &value, &updated, &wrapped)
 	if err != nil {
 		_ = tx.Rollback()
 		if strings.Contains(err.Error(), "no rows") {
@@ -649,14 +1045,17 @@ func (d *DataBase) popNewestByType(itemType string) (*src.I, error) {
 		}
 		return nil, err
 	}
-	_, err = tx.ExecContext(ctx, "DELETE FROM item WHERE item.key = ?", key)
+	// the item is kept if its value cannot be read
+	vv, err := openValue(key, iType, wrapped, value)
 	if err != nil {
 		_ = tx.Rollback()
-		return nil, fmt.Errorf("cannot delete item %s: %s", key, err.Error())
+		return nil, fmt.Errorf("cannot decrypt item %s: %w", key, err)
+	}
+	if err = shredItemTx(ctx, tx, key, iType); err != nil {
+		_ = tx.Rollback()
+		return nil, err
 	}
-	err = tx.Commit()
-	vv, decErr := decrypt(value)
-	if decErr != nil {
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 	return &src.I{
@@ -667,132 +1066,22 @@ func (d *DataBase) popNewestByType(itemType string) (*src.I, error) {
 	}, nil
 }
 
-func getDb(path string) (db *sql.DB, err error) {
-	path, err = filepath.Abs(path)
-	path = filepath.Join(path, ".cfg.db")
-	// if the index db does not exist
-	if _, err = os.Stat(path); os.IsNotExist(err) {
-		db, err = createDb(path)
-		if err != nil {
-			return db, err
-		}
-	} else {
-		db, err = sql.Open(sqlDriver, path)
-		if err != nil {
-			return nil, err
-		}
-	}
-	return db, nil
-}
-
-func createDb(path string) (*sql.DB, error) {
-	file, err := os.Create(path) // Create SQLite file
-	if err != nil {
-		return nil, fmt.Errorf("cannot create index database: %s\n", err)
-	}
-	err = file.Close()
-	if err != nil {
-		return nil, fmt.Errorf("cannot close index database: %s\n", err)
-	}
-	db, err := sql.Open(sqlDriver, path)
+func getDb(path string) (*sqlDB, error) {
+	path, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
-	if err = createSchema(db); err != nil {
-		return db, err
-	}
-	return db, nil
-}
-
-func createSchema(db *sql.DB) error {
-	// stores configuration items
-	if err := exec(db, `CREATE TABLE item (
-        "key"        VARCHAR(100) NOT NULL PRIMARY KEY,
-        "type"       VARCHAR(100) NOT NULL,
-        "value"      BLOB NOT NULL,
-		"updated"    INTEGER NOT NULL
-	    );`); err != nil {
-		return err
-	}
-	// stores tags for configuration items
-	if err := exec(db, `CREATE TABLE tag (
-        "item_key"        VARCHAR(100) NOT NULL,
-        "name"            VARCHAR(100) NOT NULL,
-        "value"           VARCHAR(100),
-        PRIMARY KEY ("item_key", "name")
-	    );`); err != nil {
-		return err
-	}
-	// stores associations between configuration items
-	if err := exec(db, `CREATE TABLE link (
-        "from_key"        VARCHAR(100) NOT NULL,
-        "to_key"          VARCHAR(100) NOT NULL,
-        PRIMARY KEY ("from_key", "to_key")
-	    );`); err != nil {
-		return err
-	}
-	// stores json schemas for validation
-	if err := exec(db, `CREATE TABLE type (
-        "key"        VARCHAR(100) NOT NULL PRIMARY KEY,
-        "schema"     BLOB NOT NULL,
-        "proto"      BLOB NOT NULL
-	    );`); err != nil {
-		return err
-	}
-	return nil
-}
-
-func exec(db *sql.DB, stmt string) error {
-	statement, err := db.Prepare(stmt)
-	if err != nil {
-		return err
-	}
-	_, err = statement.Exec()
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func toInSqlTags(tag []string) string {
-	var out strings.Builder
-	for i, t := range tag {
-		out.WriteString(fmt.Sprintf("'%s'", t))
-		if i < len(tag)-1 {
-			out.WriteString(",")
-		}
-	}
-	return fmt.Sprintf(" IN (%s);", out.String())
-}
-
-func encrypt(input []byte) ([]byte, error) {
-	key := sha256.Sum256([]byte(K))
-	block, _ := aes.NewCipher(key[:])
-	gcm, _ := cipher.NewGCM(block)
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
-	return gcm.Seal(nonce, nonce, input, nil), nil
-}
-
-func decrypt(cipherBytes []byte) ([]byte, error) {
-	key := sha256.Sum256([]byte(K))
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
+	path = filepath.Join(path, ".cfg.db")
+	// opens the database creating the file if it does not exist
+	conn, err := sql.Open(sqlDriver, path)
 	if err != nil {
 		return nil, err
 	}
-	nonce := cipherBytes[:gcm.NonceSize()]
-	cipherBytes = cipherBytes[gcm.NonceSize():]
-	bytes, err := gcm.Open(nil, nonce, cipherBytes, nil)
-	if err != nil {
+	db := &sqlDB{DB: conn, dialect: sqliteDialect}
+	// ensures the schema is up-to-date
+	if err = migrate(db); err != nil {
+		_ = db.Close()
 		return nil, err
 	}
-	return bytes, nil
+	return db, nil
 }
-
-const K = "VCh4IbXtYuFYnNa4L0xC1F49gZKZaNgrqJPMvNmac5T1W3zH0e"
@@ -44,7 +44,7 @@ func TestLifecycle(t *testing.T) {
       "key": "name2",
       "value": "value2"
     }
-]`)
+]`, 0)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -72,14 +72,14 @@ func TestLifecycle(t *testing.T) {
 			Key:   "key3",
 			Value: "value3",
 		},
-	})
+	}, 0)
 	// tag it
 	err = d.tag("test2", "init")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 	// link the two items
-	err = d.Link("test", "test2")
+	err = d.Link("test", "test2", "", nil)
 	// get items with tags
 	tagged, err := d.getTaggedItems("dev")
 	if err != nil {
@@ -105,6 +105,6 @@ func TestLifecycle(t *testing.T) {
 	// delete type
 	_ = d.DeleteType("kv")
 	// delete item
-	_ = d.DeleteItem("test")
-	_ = d.DeleteItem("test2")
+	_ = d.DeleteItem("test", 0, deleteOptions{})
+	_ = d.DeleteItem("test2", 0, deleteOptions{})
 }
@@ -0,0 +1,98 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// itemETag the entity tag of an item at a version, made of the version followed by the time of the update that wrote
+// it, so that tags of items deleted and created again never match
+func itemETag(version int64, updated time.Time, revealed bool) string {
+	return revealedETag(fmt.Sprintf("\"%d-%x\"", version, updated.UnixNano()), revealed)
+}
+
+// revealedETag marks the entity tag of a response revealing secrets, as the representations with and without secrets
+// differ
+func revealedETag(etag string, revealed bool) string {
+	if !revealed {
+		return etag
+	}
+	return strings.TrimSuffix(etag, "\"") + "-r\""
+}
+
+// ifMatchVersion the item version required by the If-Match header of a request
+// returns zero if the header is not present and anyVersion if it is "*"
+func ifMatchVersion(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(value) == 0 {
+		return 0, nil
+	}
+	if value == "*" {
+		return anyVersion, nil
+	}
+	// weak tags never match for If-Match, but item versions are always strong so the prefix is just ignored
+	tag := strings.Trim(strings.TrimPrefix(value, "W/"), "\"")
+	// versions are never reused, so the version the tag starts with identifies the item state on its own
+	tag, _, _ = strings.Cut(tag, "-")
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match header '%s', expected an item version entity tag", value)
+	}
+	return version, nil
+}
+
+// notModified checks the conditional headers of a GET request against the entity tag and last modification time of
+// the requested resource, both are set as response headers and if the client copy is current a 304 response is
+// written and true is returned
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	// If-None-Match takes precedence over If-Modified-Since
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		if etagMatch(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 && !modified.IsZero() {
+		since, err := http.ParseTime(ims)
+		// http dates have a resolution of one second
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatch true if any of the entity tags in a If-None-Match header value matches the specified tag using weak
+// comparison
+func etagMatch(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// stampETag the entity tag for a collection of items computed from a content hash of their keys and versions
+func stampETag(hash []byte) string {
+	return fmt.Sprintf("\"%x\"", hash[:16])
+}
@@ -0,0 +1,67 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestItemETag(t *testing.T) {
+	UseStore(NewMemoryStore())
+	if err := db.setTypeFromString("conn", []byte(`{"properties":{"password":{"x-secret":true}}}`), nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ := db.SetItem("c1", "conn", `{"password":"s3cret"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	AllowReveal(true)
+	defer AllowReveal(false)
+	get := func(query string, header http.Header) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/item/c1"+query, nil), map[string]string{"key": "c1"})
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		GetItemHandler(w, r)
+		return w
+	}
+	masked := get("", nil).Header().Get("ETag")
+	revealed := get("?reveal=true", nil).Header().Get("ETag")
+	if len(masked) == 0 || masked == revealed {
+		t.Fatalf("expected the masked and revealed representations to have different entity tags, got %s and %s", masked, revealed)
+	}
+	if w := get("", http.Header{"If-None-Match": {masked}}); w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", w.Code)
+	}
+	// the masked copy is not current for a request revealing secrets
+	if w := get("?reveal=true", http.Header{"If-None-Match": {masked}}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	// the tags of an item created again differ even though versions are never reused
+	if err := db.DeleteItem("c1", 0, deleteOptions{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ := db.SetItem("c1", "conn", `{"password":"s3cret"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if tag := get("", nil).Header().Get("ETag"); tag == masked {
+		t.Fatalf("expected a new entity tag, got %s", tag)
+	}
+	// entity tags are accepted by If-Match
+	for _, tag := range []string{masked, revealed, `"1"`} {
+		r := httptest.NewRequest("PUT", "/item/c1", nil)
+		r.Header.Set("If-Match", tag)
+		if version, err := ifMatchVersion(r); err != nil || version != 1 {
+			t.Fatalf("If-Match %s: expected version 1, got %d (%v)", tag, version, err)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// minKeyLength the minimum length of the key material provided by a KeyProvider
+const minKeyLength = 16
+
+// the layouts of encrypted values: a format byte and the identifier of the key that encrypted the value, followed by
+// the AES-GCM nonce and sealed data
+const (
+	// formatKeyId values are not bound to their item, only read when migrating existing values
+	formatKeyId byte = 1
+	// formatBound values are authenticated together with the key and type of their item
+	formatBound  byte = 2
+	keyIdLength       = 8
+	cipherHeader      = 1 + keyIdLength
+)
+
+var (
+	ErrNoKey      = errors.New("encryption key not configured, set SOURCE_ENCRYPTION_KEY or SOURCE_ENCRYPTION_KEY_FILE")
+	ErrUnknownKey = errors.New("value encrypted with a key not in the keyring")
+	// ErrIntegrity an encrypted value has been altered or does not belong to the item it is stored in
+	ErrIntegrity = errors.New("item value failed integrity check")
+)
+
+// the master keys wrapping the data keys of items
+var keys *keyring
+
+// keyring the keys known to the service, new values are encrypted with the active key whilst the other keys are only
+// used to decrypt values written before a key rotation
+type keyring struct {
+	active *dataKey
+	keys   map[string]*dataKey
+}
+
+// dataKey an AES-256 key and its identifier
+type dataKey struct {
+	id  []byte
+	key []byte
+}
+
+// newDataKey derives an AES-256 key from key material, its identifier is a hash of the key so it can be recorded
+// alongside encrypted values without disclosing the key
+func newDataKey(material []byte) (*dataKey, error) {
+	if len(material) < minKeyLength {
+		return nil, fmt.Errorf("encryption key must be at least %d characters long", minKeyLength)
+	}
+	key := sha256.Sum256(material)
+	id := sha256.Sum256(key[:])
+	return &dataKey{id: id[:keyIdLength], key: key[:]}, nil
+}
+
+// KeyId the printable identifier of the key
+func (k *dataKey) KeyId() string {
+	return hex.EncodeToString(k.id)
+}
+
+// KeyProvider provides the key material from which the key encrypting item values at rest is derived
+type KeyProvider interface {
+	// Key the key material, it is hashed with SHA-256 to derive the AES-256 key
+	Key() ([]byte, error)
+}
+
+// EnvKeyProvider reads the key material from an environment variable
+type EnvKeyProvider struct {
+	Var string
+}
+
+func (p EnvKeyProvider) Key() ([]byte, error) {
+	value, ok := os.LookupEnv(p.Var)
+	if !ok || len(value) == 0 {
+		return nil, fmt.Errorf("environment variable %s is not set", p.Var)
+	}
+	return []byte(value), nil
+}
+
+// FileKeyProvider reads the key material from a file, surrounding whitespace is ignored
+type FileKeyProvider struct {
+	Path string
+}
+
+func (p FileKeyProvider) Key() ([]byte, error) {
+	content, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %s", err)
+	}
+	return []byte(strings.TrimSpace(string(content))), nil
+}
+
+// SetKeyProvider sets the provider of the active key encrypting item values at rest, replacing any keys previously
+// set; must be called before Init to take precedence over the environment configuration
+func SetKeyProvider(p KeyProvider) error {
+	material, err := p.Key()
+	if err != nil {
+		return err
+	}
+	key, err := newDataKey(material)
+	if err != nil {
+		return err
+	}
+	keys = &keyring{
+		active: key,
+		keys:   map[string]*dataKey{key.KeyId(): key},
+	}
+	return nil
+}
+
+// AddRetiredKey adds a key that is only used to decrypt values encrypted before it was rotated
+func AddRetiredKey(p KeyProvider) error {
+	if keys == nil {
+		return ErrNoKey
+	}
+	material, err := p.Key()
+	if err != nil {
+		return err
+	}
+	key, err := newDataKey(material)
+	if err != nil {
+		return err
+	}
+	if _, exists := keys.keys[key.KeyId()]; !exists {
+		keys.keys[key.KeyId()] = key
+	}
+	return nil
+}
+
+// loadKey loads the encryption keys from the environment if a key provider has not been set
+// SOURCE_ENCRYPTION_KEY_FILE takes precedence over SOURCE_ENCRYPTION_KEY for the active key, retired keys are read
+// from the file at SOURCE_ENCRYPTION_RETIRED_KEYS_FILE, one per line
+func loadKey() error {
+	if keys != nil {
+		return nil
+	}
+	var err error
+	if path := os.Getenv("SOURCE_ENCRYPTION_KEY_FILE"); len(path) > 0 {
+		err = SetKeyProvider(FileKeyProvider{Path: path})
+	} else if len(os.Getenv("SOURCE_ENCRYPTION_KEY")) > 0 {
+		err = SetKeyProvider(EnvKeyProvider{Var: "SOURCE_ENCRYPTION_KEY"})
+	} else {
+		return ErrNoKey
+	}
+	if err != nil {
+		return err
+	}
+	if path := os.Getenv("SOURCE_ENCRYPTION_RETIRED_KEYS_FILE"); len(path) > 0 {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot read retired keys file: %s", err)
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if line = strings.TrimSpace(line); len(line) == 0 {
+				continue
+			}
+			if err = AddRetiredKey(keyMaterial(line)); err != nil {
+				return fmt.Errorf("invalid retired key: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// keyMaterial provides key material held in memory
+type keyMaterial string
+
+func (k keyMaterial) Key() ([]byte, error) {
+	return []byte(k), nil
+}
+
+// itemData the additional data authenticated with the value of an item, binding the encrypted value to the key and
+// type of the item so that values cannot be moved between items undetected
+func itemData(key, iType string) []byte {
+	return []byte(key + "\x00" + iType)
+}
+
+// encrypt the value of an item with the active key, prefixing the result with the key identifier
+func encrypt(input, data []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+	sealed, err := encryptWith(keys.active.key, input, data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, cipherHeader+len(sealed))
+	out = append(out, formatBound)
+	out = append(out, keys.active.id...)
+	return append(out, sealed...), nil
+}
+
+// decrypt the value of an item with the key identified by its prefix
+// returns ErrIntegrity if the value cannot be authenticated
+func decrypt(cipherBytes, data []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+	key, err := cipherKey(cipherBytes, formatBound)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptWith(key.key, cipherBytes[cipherHeader:], data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIntegrity, err)
+	}
+	return plain, nil
+}
+
+// cipherKey the key that encrypted a value in the specified format
+func cipherKey(cipherBytes []byte, format byte) (*dataKey, error) {
+	if len(cipherBytes) < cipherHeader || cipherBytes[0] != format {
+		return nil, fmt.Errorf("%w: unsupported cipher text format", ErrIntegrity)
+	}
+	id := hex.EncodeToString(cipherBytes[1:cipherHeader])
+	key, ok := keys.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// activeKeyEncrypted true if a value is encrypted with the active key
+func activeKeyEncrypted(cipherBytes []byte) bool {
+	return len(cipherBytes) >= cipherHeader && cipherBytes[0] == formatBound &&
+		bytes.Equal(cipherBytes[1:cipherHeader], keys.active.id)
+}
+
+func encryptWith(key, input, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, input, data), nil
+}
+
+func decryptWith(key, cipherBytes, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherBytes) < gcm.NonceSize() {
+		return nil, fmt.Errorf("cipher text is too short")
+	}
+	nonce := cipherBytes[:gcm.NonceSize()]
+	cipherBytes = cipherBytes[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, cipherBytes, data)
+}
+
+// legacyKey the key material compiled into releases before the encryption key was externalised
+// only used to re-encrypt existing data with the configured key
+const legacyKey = "VCh4IbXtYuFYnNa4L0xC1F49gZKZaNgrqJPMvNmac5T1W3zH0e"
+
+// reEncryptLegacy re-encrypts item values encrypted with the legacy key using the configured key
+func reEncryptLegacy(tx *sqlTx) error {
+	legacy := sha256.Sum256([]byte(legacyKey))
+	return reEncryptValues(tx, func(key, iType string, value []byte) ([]byte, error) {
+		plain, err := decryptWith(legacy[:], value, nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item '%s' with the legacy key: %s", key, err)
+		}
+		// values are written in the layout used at this schema version, they gain a key identifier in a later migration
+		return encryptWith(keys.active.key, plain, nil)
+	})
+}
+
+// prefixKeyIds prefixes values encrypted before key identifiers were recorded with the identifier of their key
+func prefixKeyIds(tx *sqlTx) error {
+	return reEncryptValues(tx, func(key, iType string, value []byte) ([]byte, error) {
+		// tries the active key first as values are normally encrypted with it
+		candidates := []*dataKey{keys.active}
+		for _, k := range keys.keys {
+			if k != keys.active {
+				candidates = append(candidates, k)
+			}
+		}
+		for _, k := range candidates {
+			if _, err := decryptWith(k.key, value, nil); err == nil {
+				out := append([]byte{formatKeyId}, k.id...)
+				return append(out, value...), nil
+			}
+		}
+		return nil, fmt.Errorf("cannot decrypt item '%s' with any configured key", key)
+	})
+}
+
+// bindValues re-encrypts values with the key and type of their item as additional data
+func bindValues(tx *sqlTx) error {
+	return reEncryptValues(tx, func(key, iType string, value []byte) ([]byte, error) {
+		k, err := cipherKey(value, formatKeyId)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read item '%s': %s", key, err)
+		}
+		plain, err := decryptWith(k.key, value[cipherHeader:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item '%s': %s", key, err)
+		}
+		return encrypt(plain, itemData(key, iType))
+	})
+}
+
+// reEncryptValues transforms the encrypted values of all items and item revisions within a transaction
+func reEncryptValues(tx *sqlTx, transform func(key, iType string, value []byte) ([]byte, error)) error {
+	type encrypted struct {
+		key      string
+		revision int64
+		iType    string
+		value    []byte
+	}
+	// reads all rows before updating them as the transaction holds a single connection
+	read := func(query string, revisions bool) ([]encrypted, error) {
+		rows, err := tx.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var result []encrypted
+		for rows.Next() {
+			var e encrypted
+			if revisions {
+				err = rows.Scan(&e.key, &e.revision, &e.iType, &e.value)
+			} else {
+				err = rows.Scan(&e.key, &e.iType, &e.value)
+			}
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, e)
+		}
+		return result, rows.Err()
+	}
+	items, err := read(`SELECT key, type, value FROM item;`, false)
+	if err != nil {
+		return err
+	}
+	revisions, err := read(`SELECT item_key, revision, type, value FROM item_revision;`, true)
+	if err != nil {
+		return err
+	}
+	// a database without values to convert can be migrated before a key is configured
+	if keys == nil && len(items)+len(revisions) > 0 {
+		return ErrNoKey
+	}
+	for _, i := range items {
+		value, err := transform(i.key, i.iType, i.value)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE item SET value = ? WHERE key = ?;`, value, i.key); err != nil {
+			return err
+		}
+	}
+	for _, r := range revisions {
+		value, err := transform(r.key, r.iType, r.value)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE item_revision SET value = ? WHERE item_key = ? AND revision = ?;`, value, r.key, r.revision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIntegrity(t *testing.T) {
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("a", "", `{"role":"user"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("b", "", `{"role":"admin"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// swaps the encrypted value of the items as someone with write access to the database file could do
+	if _, err = d.db.Exec(`UPDATE item SET value = (SELECT value FROM item WHERE key = 'b') WHERE key = 'a';`); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.getItem("a"); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	if _, err = d.getItems(); !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	if _, err = d.getItem("b"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// exports do not read item values
+	if err = d.Link("a", "b", "", nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if nodes, _, err := exportGraph(d, "", 0, nil); err != nil || len(nodes) != 2 {
+		t.Fatalf("expected the items to be exported, got %v %v", nodes, err)
+	}
+}
+
+func TestShred(t *testing.T) {
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err, _ = d.SetItem(key, "", `{"name":"`+key+`"}`, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// a value whose data key has been destroyed cannot be read
+	if _, err = d.db.Exec(`DELETE FROM data_key WHERE item_key = 'c';`); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.getItem("c"); !errors.Is(err, ErrShredded) {
+		t.Fatalf("expected a shredded item error, got %v", err)
+	}
+	if err = d.shredItem("c"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = d.shredItem("a"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.getItem("a"); err != ErrNotFound {
+		t.Fatalf("expected the shredded item to be removed, got %v", err)
+	}
+	var count int
+	if err = d.db.QueryRow(`SELECT COUNT(*) FROM data_key;`).Scan(&count); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 data key left, got %d", count)
+	}
+	if _, err = d.getItem("b"); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
@@ -0,0 +1,173 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"strconv"
+	"strings"
+)
+
+// dialect the differences in sql between the supported databases
+// statements are written for sqlite and translated by the dialect where needed
+type dialect struct {
+	name string
+	// numbered uses numbered placeholders ($1, $2, ...) instead of ?
+	numbered bool
+	// skipLocked the clause locking a selected row and skipping rows locked by other transactions
+	skipLocked string
+	// forUpdate the clause locking selected rows until the end of the transaction
+	forUpdate string
+	// forShare the clause preventing selected rows from being changed until the end of the transaction
+	forShare string
+	// migrationLock the statement serialising migrations run by concurrent instances of the service
+	migrationLock string
+	// types translates column types in data definition statements
+	types *strings.Replacer
+}
+
+var (
+	sqliteDialect = &dialect{
+		name: "sqlite",
+	}
+	postgresDialect = &dialect{
+		name:          "postgres",
+		numbered:      true,
+		skipLocked:    " FOR UPDATE SKIP LOCKED",
+		forUpdate:     " FOR UPDATE",
+		forShare:      " FOR SHARE",
+		migrationLock: "SELECT pg_advisory_xact_lock(4327116);",
+		types:         strings.NewReplacer("BLOB", "BYTEA", "INTEGER", "BIGINT"),
+	}
+)
+
+// rebind rewrites the placeholders of a statement for the dialect, ignoring question marks in string literals
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var (
+		out     strings.Builder
+		n       int
+		literal bool
+	)
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			literal = !literal
+			out.WriteRune(c)
+		case c == '?' && !literal:
+			n++
+			out.WriteString("$")
+			out.WriteString(strconv.Itoa(n))
+		default:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// ddl translates a data definition statement for the dialect
+func (d *dialect) ddl(stmt string) string {
+	if d.types == nil {
+		return stmt
+	}
+	return d.types.Replace(stmt)
+}
+
+// sqlDB a database connection pool that translates statements for its dialect
+type sqlDB struct {
+	*sql.DB
+	dialect *dialect
+}
+
+func (db *sqlDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.ExecContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRowContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *sqlDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sqlTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+// sqlTx a transaction that translates statements for its dialect
+type sqlTx struct {
+	*sql.Tx
+	dialect *dialect
+}
+
+func (tx *sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.QueryContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.rebind(query), args...)
+}
+
+func (tx *sqlTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(ctx, tx.dialect.rebind(query), args...)
+}
+
+// newPgDb create a configuration database on the PostgreSQL server at the specified connection url
+// several instances of the service can share the same database
+func newPgDb(url string) (*DataBase, error) {
+	conn, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	db := &sqlDB{DB: conn, dialect: postgresDialect}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot connect to postgres database: %s", err)
+	}
+	// ensures the schema is up-to-date
+	if err = migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &DataBase{db: db}, nil
+}
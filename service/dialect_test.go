@@ -0,0 +1,24 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	stmt := `UPDATE item SET value = ? WHERE key = ? AND type <> '?';`
+	if got := sqliteDialect.rebind(stmt); got != stmt {
+		t.Fatalf("sqlite statement should not change, got %s", got)
+	}
+	expected := `UPDATE item SET value = $1 WHERE key = $2 AND type <> '?';`
+	if got := postgresDialect.rebind(stmt); got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
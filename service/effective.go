@@ -0,0 +1,159 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// arrayStrategies how arrays of successive layers are merged
+var arrayStrategies = []string{"replace", "append", "union"}
+
+// EffectiveConfig the value of an item merged over the values of its ancestors
+type EffectiveConfig struct {
+	// Key the key of the item
+	Key string `json:"key"`
+	// Layers the keys of the items merged, in merge order, the item itself being the last one
+	Layers []string `json:"layers"`
+	// Value the merged value
+	Value json.RawMessage `json:"value"`
+	// Provenance the key of the item supplying each value of the merged value, by JSON Pointer
+	Provenance map[string]string `json:"provenance"`
+}
+
+// effectiveConfig merges the value of an item over the values of its ancestors, found by following links of the
+// specified kind from children to parents, or links of any kind but references if no kind is specified
+// ancestors are merged from the farthest to the closest, those at the same distance in key order, so that values of
+// closer layers win; arrays are merged using one of arrayStrategies and the secret properties of each layer are masked
+// by the masker
+func effectiveConfig(s Store, key, rel, arrays string, masker *secretMasker) (*EffectiveConfig, error) {
+	kinds := linkKinds{only: rel}
+	if len(rel) == 0 {
+		kinds = linkKinds{except: refRel}
+	}
+	graph, err := s.getGraph(key, true, 0, kinds)
+	if err != nil {
+		return nil, err
+	}
+	items := graph.Items
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Depth != items[j].Depth {
+			return items[i].Depth > items[j].Depth
+		}
+		return items[i].Key < items[j].Key
+	})
+	m := &layerMerger{arrays: arrays, provenance: map[string]string{}}
+	layers := make([]string, 0, len(items))
+	var merged interface{}
+	for _, item := range items {
+		value, err := masker.mask(item.Type, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		doc, err := decodeJson(value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode item %s: %s", item.Key, err)
+		}
+		merged = m.merge(merged, doc, nil, item.Key)
+		layers = append(layers, item.Key)
+	}
+	value, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return &EffectiveConfig{Key: key, Layers: layers, Value: value, Provenance: m.provenance}, nil
+}
+
+// layerMerger deep merges json values keeping track of the layer supplying each value
+type layerMerger struct {
+	arrays     string
+	provenance map[string]string
+}
+
+// merge merges a value of a layer over the value merged so far at a path
+func (m *layerMerger) merge(base, layer interface{}, path []string, key string) interface{} {
+	switch l := layer.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			m.forget(path)
+			b = map[string]interface{}{}
+		}
+		if len(l) == 0 && len(b) == 0 {
+			m.provenance[pointerString(path)] = key
+		}
+		for k, v := range l {
+			b[k] = m.merge(b[k], v, append(append([]string{}, path...), k), key)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || m.arrays == "replace" {
+			m.forget(path)
+			m.supply(l, path, key)
+			return l
+		}
+		for _, v := range l {
+			if m.arrays == "union" && containsJson(b, v) {
+				continue
+			}
+			m.supply(v, append(append([]string{}, path...), strconv.Itoa(len(b))), key)
+			b = append(b, v)
+		}
+		return b
+	}
+	m.forget(path)
+	m.provenance[pointerString(path)] = key
+	return layer
+}
+
+// supply records the layer supplying a value and the values it contains
+func (m *layerMerger) supply(value interface{}, path []string, key string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			for k, e := range v {
+				m.supply(e, append(append([]string{}, path...), k), key)
+			}
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			for i, e := range v {
+				m.supply(e, append(append([]string{}, path...), strconv.Itoa(i)), key)
+			}
+			return
+		}
+	}
+	m.provenance[pointerString(path)] = key
+}
+
+// forget removes the provenance of the value at a path and the values it contains
+func (m *layerMerger) forget(path []string) {
+	prefix := pointerString(path)
+	for p := range m.provenance {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			delete(m.provenance, p)
+		}
+	}
+}
+
+// containsJson true if an array has an element equal to a value
+func containsJson(array []interface{}, value interface{}) bool {
+	for _, e := range array {
+		if jsonEqual(e, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			items := map[string]string{
+				"base":   `{"db":{"host":"localhost","port":5432},"hosts":["a"],"debug":true}`,
+				"prod":   `{"db":{"host":"db.prod"},"hosts":["b","a"],"debug":false}`,
+				"eu":     `{"db":{"port":6432},"hosts":["c"]}`,
+				"shared": `{"db":{"host":"shared"}}`,
+			}
+			for key, value := range items {
+				if err, _ := s.SetItem(key, "", value, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			for _, l := range [][3]string{{"base", "prod", ""}, {"prod", "eu", ""}, {"shared", "eu", refRel}} {
+				if err := s.Link(l[0], l[1], l[2], nil); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			// links from missing items, created before link endpoints were validated, do not add layers
+			switch store := s.(type) {
+			case *DataBase:
+				if _, err := store.db.Exec(`INSERT INTO link(from_key, to_key, rel) VALUES('ghost', 'base', '');`); err != nil {
+					t.Fatalf(err.Error())
+				}
+			case *memStore:
+				store.links[linkKey{From: "ghost", To: "base"}] = nil
+			}
+			cases := []struct {
+				arrays, value, provenance string
+			}{
+				{
+					arrays:     "replace",
+					value:      `{"db":{"host":"db.prod","port":6432},"debug":false,"hosts":["c"]}`,
+					provenance: "map[/db/host:prod /db/port:eu /debug:prod /hosts/0:eu]",
+				},
+				{
+					arrays:     "append",
+					value:      `{"db":{"host":"db.prod","port":6432},"debug":false,"hosts":["a","b","a","c"]}`,
+					provenance: "map[/db/host:prod /db/port:eu /debug:prod /hosts/0:base /hosts/1:prod /hosts/2:prod /hosts/3:eu]",
+				},
+				{
+					arrays:     "union",
+					value:      `{"db":{"host":"db.prod","port":6432},"debug":false,"hosts":["a","b","c"]}`,
+					provenance: "map[/db/host:prod /db/port:eu /debug:prod /hosts/0:base /hosts/1:prod /hosts/2:eu]",
+				},
+			}
+			for _, c := range cases {
+				e, err := effectiveConfig(s, "eu", "", c.arrays, nil)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				if fmt.Sprint(e.Layers) != "[base prod eu]" {
+					t.Fatalf("%s: unexpected layers %v", c.arrays, e.Layers)
+				}
+				if string(e.Value) != c.value {
+					t.Fatalf("%s: expected %s, got %s", c.arrays, c.value, e.Value)
+				}
+				if fmt.Sprint(e.Provenance) != c.provenance {
+					t.Fatalf("%s: expected provenance %s, got %v", c.arrays, c.provenance, e.Provenance)
+				}
+			}
+			// only the links of the kind specified are followed
+			e, err := effectiveConfig(s, "eu", refRel, "replace", nil)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if fmt.Sprint(e.Layers) != "[shared eu]" || string(e.Value) != `{"db":{"host":"shared","port":6432},"hosts":["c"]}` {
+				t.Fatalf("unexpected effective configuration %v %s", e.Layers, e.Value)
+			}
+			if _, err = effectiveConfig(s, "missing", "", "replace", nil); err != ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		})
+	}
+}
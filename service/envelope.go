@@ -0,0 +1,239 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// item values are encrypted with a random data key per item, which is stored wrapped (encrypted) by the active master
+// key of the keyring; rotating the master key only rewraps the data keys and destroying the data key of an item makes
+// its value and revisions unreadable (crypto-shredding)
+
+// formatEnvelope values encrypted with the data key of their item, the format byte is followed by the AES-GCM nonce
+// and sealed data
+const formatEnvelope byte = 3
+
+// ErrShredded the data key of an item has been destroyed so its value can no longer be read
+var ErrShredded = errors.New("item data key has been destroyed")
+
+// keyData the additional data authenticated with a wrapped data key, binding it to its item
+func keyData(key string) []byte {
+	return []byte("data key\x00" + key)
+}
+
+// newItemKey generates a random data key for an item and wraps it with the active master key
+func newItemKey(key string) (plain, wrapped []byte, err error) {
+	plain = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, plain); err != nil {
+		return nil, nil, err
+	}
+	if wrapped, err = encrypt(plain, keyData(key)); err != nil {
+		return nil, nil, err
+	}
+	return plain, wrapped, nil
+}
+
+// unwrapItemKey decrypts the data key of an item with the master key that wrapped it
+// a nil wrapped key means the data key has been destroyed
+func unwrapItemKey(key string, wrapped []byte) ([]byte, error) {
+	if wrapped == nil {
+		return nil, ErrShredded
+	}
+	return decrypt(wrapped, keyData(key))
+}
+
+// itemKey gets the data key of an item within a transaction, creating it if the item does not have one
+func itemKey(ctx context.Context, tx *sqlTx, key string) ([]byte, error) {
+	var wrapped []byte
+	err := tx.QueryRowContext(ctx, `SELECT wrapped FROM data_key WHERE item_key = ?;`, key).Scan(&wrapped)
+	if err == nil {
+		return unwrapItemKey(key, wrapped)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+	plain, wrapped, err := newItemKey(key)
+	if err != nil {
+		return nil, err
+	}
+	// another writer may have created the key in the meantime, in which case its key is used
+	res, err := tx.ExecContext(ctx, `INSERT INTO data_key(item_key, wrapped, created) VALUES(?, ?, ?) ON CONFLICT(item_key) DO NOTHING;`, key, wrapped, time.Now().UTC().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return plain, nil
+	}
+	if err = tx.QueryRowContext(ctx, `SELECT wrapped FROM data_key WHERE item_key = ?;`, key).Scan(&wrapped); err != nil {
+		return nil, err
+	}
+	return unwrapItemKey(key, wrapped)
+}
+
+// sealValue encrypts the value of an item with its data key
+func sealValue(dek []byte, key, iType string, value []byte) ([]byte, error) {
+	sealed, err := encryptWith(dek, value, itemData(key, iType))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{formatEnvelope}, sealed...), nil
+}
+
+// openValue decrypts the value of an item using its wrapped data key
+// returns ErrIntegrity if the value cannot be authenticated and ErrShredded if the data key has been destroyed
+func openValue(key, iType string, wrapped, value []byte) ([]byte, error) {
+	dek, err := unwrapItemKey(key, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) < 1 || value[0] != formatEnvelope {
+		return nil, fmt.Errorf("%w: unsupported cipher text format", ErrIntegrity)
+	}
+	plain, err := decryptWith(dek, value[1:], itemData(key, iType))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIntegrity, err)
+	}
+	return plain, nil
+}
+
+// envelopeValues creates a data key for every item and re-encrypts item values and revisions with it
+func envelopeValues(tx *sqlTx) error {
+	if _, err := tx.Exec(tx.dialect.ddl(`CREATE TABLE data_key
+	(
+        "item_key" TEXT NOT NULL PRIMARY KEY,
+        "wrapped"  BLOB NOT NULL,
+        "created"  INTEGER NOT NULL
+	);`)); err != nil {
+		return err
+	}
+	dataKeys := map[string][]byte{}
+	return reEncryptValues(tx, func(key, iType string, value []byte) ([]byte, error) {
+		plain, err := decrypt(value, itemData(key, iType))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt item '%s': %s", key, err)
+		}
+		dek, ok := dataKeys[key]
+		if !ok {
+			var wrapped []byte
+			if dek, wrapped, err = newItemKey(key); err != nil {
+				return nil, err
+			}
+			if _, err = tx.Exec(`INSERT INTO data_key(item_key, wrapped, created) VALUES(?, ?, ?);`, key, wrapped, time.Now().UTC().UnixNano()); err != nil {
+				return nil, err
+			}
+			dataKeys[key] = dek
+		}
+		return sealValue(dek, key, iType, plain)
+	})
+}
+
+// shredder implemented by stores able to destroy the data keys of items
+type shredder interface {
+	// shredItem destroy the data key of an item and remove the item
+	shredItem(key string) error
+	// shredType destroy the data keys of all items of a type and remove the items, returns the number of items removed
+	shredType(iType string) (int64, error)
+}
+
+// shredItem destroys the data key of an item, making its value unreadable in backups and replicas of the database
+// once the master keys that wrapped it are retired, and removes the item, its revisions, tags and links
+func (d *DataBase) shredItem(key string) error {
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	var iType string
+	if err = tx.QueryRowContext(ctx, `SELECT type FROM item WHERE key = ?;`, key).Scan(&iType); err != nil {
+		_ = tx.Rollback()
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+	if err = shredItemTx(ctx, tx, key, iType); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// shredType destroys the data keys of all items of a type and removes the items
+func (d *DataBase) shredType(iType string) (int64, error) {
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT key FROM item WHERE type = ?;`, iType)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	var itemKeys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			break
+		}
+		itemKeys = append(itemKeys, key)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	for _, key := range itemKeys {
+		if err = shredItemTx(ctx, tx, key, iType); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+	return int64(len(itemKeys)), tx.Commit()
+}
+
+// shredItemTx destroys the data key of an item and removes the item within a transaction
+func shredItemTx(ctx context.Context, tx *sqlTx, key, iType string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM data_key WHERE item_key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot destroy data key of item %s: %s", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item_revision WHERE item_key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot delete revisions of item %s: %s", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item_field WHERE item_key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot delete indexed fields of item %s: %s", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM tag WHERE item_key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot delete tags of item %s: %s", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM link WHERE from_key = ? OR to_key = ?;`, key, key); err != nil {
+		return fmt.Errorf("cannot delete links of item %s: %s", key, err)
+	}
+	// references to the item are kept so that they are linked if it is created again
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item_reference WHERE from_key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot delete references of item %s: %s", key, err)
+	}
+	if err := recordLastVersion(ctx, tx, key); err != nil {
+		return fmt.Errorf("cannot record version of item %s: %s", key, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item WHERE key = ?;`, key); err != nil {
+		return fmt.Errorf("cannot delete item %s: %s", key, err)
+	}
+	return recordDeletion(ctx, tx, iType)
+}
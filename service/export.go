@@ -0,0 +1,262 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// graphFormats the content types of the formats items and links can be exported to
+var graphFormats = map[string]string{
+	"dot":     "text/vnd.graphviz",
+	"graphml": "application/graphml+xml",
+	"mermaid": "text/plain",
+}
+
+// exportNode an item drawn in an exported graph
+type exportNode struct {
+	Key  string
+	Type string
+	// Tags the selected tags of the item as name or name=value
+	Tags []string
+}
+
+// label the lines describing the item
+func (n exportNode) label() []string {
+	lines := []string{n.Key}
+	if len(n.Type) > 0 {
+		lines = append(lines, n.Type)
+	}
+	return append(lines, n.Tags...)
+}
+
+// exportGraph the items and links to draw, either the descendants of a root item up to a depth or, without a root,
+// all the linked items
+func exportGraph(s Store, root string, depth int, tagNames []string) ([]exportNode, []Link, error) {
+	var (
+		nodes []exportNode
+		links []Link
+	)
+	if len(root) > 0 {
+		g, err := s.getGraph(root, false, depth, allLinks)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, i := range g.Items {
+			nodes = append(nodes, exportNode{Key: i.Key, Type: i.Type})
+		}
+		links = g.Links
+	} else {
+		var err error
+		if links, err = s.getLinks(""); err != nil {
+			return nil, nil, err
+		}
+		linked := map[string]bool{}
+		for _, l := range links {
+			linked[l.From], linked[l.To] = true, true
+		}
+		// item values are not needed to draw the items
+		types, err := s.getItemTypes()
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, iType := range types {
+			if linked[key] {
+				nodes = append(nodes, exportNode{Key: key, Type: iType})
+			}
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Key < nodes[j].Key })
+	}
+	// leaves out links to missing items, which could be created before link endpoints were validated, as every edge
+	// drawn must join declared nodes
+	found := map[string]bool{}
+	for _, n := range nodes {
+		found[n.Key] = true
+	}
+	var valid []Link
+	for _, l := range links {
+		if found[l.From] && found[l.To] {
+			valid = append(valid, l)
+		}
+	}
+	links = valid
+	if len(tagNames) > 0 {
+		tags, err := s.getAllTags()
+		if err != nil {
+			return nil, nil, err
+		}
+		selected := map[string]map[string]string{}
+		for _, t := range tags {
+			if contains(tagNames, t.Name) {
+				if selected[t.ItemKey] == nil {
+					selected[t.ItemKey] = map[string]string{}
+				}
+				selected[t.ItemKey][t.Name] = t.Value
+			}
+		}
+		// tags are listed in the order they were selected
+		for i := range nodes {
+			for _, name := range tagNames {
+				value, ok := selected[nodes[i].Key][name]
+				if !ok {
+					continue
+				}
+				if len(value) > 0 {
+					name += "=" + value
+				}
+				nodes[i].Tags = append(nodes[i].Tags, name)
+			}
+		}
+	}
+	return nodes, links, nil
+}
+
+// writeDot writes a graph in the Graphviz DOT language
+func writeDot(w io.Writer, nodes []exportNode, links []Link) error {
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+	var b strings.Builder
+	b.WriteString("digraph source {\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "  %s [label=%s];\n", quote(n.Key), quote(strings.Join(n.label(), "\n")))
+	}
+	for _, l := range links {
+		if len(l.Rel) > 0 {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n", quote(l.From), quote(l.To), quote(l.Rel))
+		} else {
+			fmt.Fprintf(&b, "  %s -> %s;\n", quote(l.From), quote(l.To))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeMermaid writes a graph as a Mermaid flowchart
+// item keys are not valid node identifiers in Mermaid so nodes are numbered and labelled with their keys
+func writeMermaid(w io.Writer, nodes []exportNode, links []Link) error {
+	escape := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;", "|", "#124;")
+	ids := map[string]string{}
+	var b strings.Builder
+	b.WriteString("flowchart TD\n")
+	for i, n := range nodes {
+		ids[n.Key] = fmt.Sprintf("n%d", i)
+		lines := n.label()
+		for j := range lines {
+			lines[j] = escape.Replace(lines[j])
+		}
+		fmt.Fprintf(&b, "  %s[\"%s\"]\n", ids[n.Key], strings.Join(lines, "<br/>"))
+	}
+	for _, l := range links {
+		if len(l.Rel) > 0 {
+			fmt.Fprintf(&b, "  %s -->|\"%s\"| %s\n", ids[l.From], escape.Replace(l.Rel), ids[l.To])
+		} else {
+			fmt.Fprintf(&b, "  %s --> %s\n", ids[l.From], ids[l.To])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	Id   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	Id          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	Id   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// writeGraphML writes a graph in the GraphML format, with the type, label and selected tags of items and the
+// relationship of links as data
+func writeGraphML(w io.Writer, nodes []exportNode, links []Link) error {
+	doc := graphML{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{Id: "type", For: "node", Name: "type", Type: "string"},
+			{Id: "label", For: "node", Name: "label", Type: "string"},
+			{Id: "tags", For: "node", Name: "tags", Type: "string"},
+			{Id: "rel", For: "edge", Name: "rel", Type: "string"},
+		},
+		Graph: graphMLGraph{Id: "source", EdgeDefault: "directed"},
+	}
+	for _, n := range nodes {
+		node := graphMLNode{Id: n.Key, Data: []graphMLData{{Key: "label", Value: strings.Join(n.label(), "\n")}}}
+		if len(n.Type) > 0 {
+			node.Data = append(node.Data, graphMLData{Key: "type", Value: n.Type})
+		}
+		if len(n.Tags) > 0 {
+			node.Data = append(node.Data, graphMLData{Key: "tags", Value: strings.Join(n.Tags, ",")})
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, node)
+	}
+	for _, l := range links {
+		edge := graphMLEdge{Source: l.From, Target: l.To}
+		if len(l.Rel) > 0 {
+			edge.Data = append(edge.Data, graphMLData{Key: "rel", Value: l.Rel})
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, edge)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeGraphFormat writes a graph in the specified format
+func writeGraphFormat(w io.Writer, format string, nodes []exportNode, links []Link) error {
+	switch format {
+	case "dot":
+		return writeDot(w, nodes, links)
+	case "graphml":
+		return writeGraphML(w, nodes, links)
+	case "mermaid":
+		return writeMermaid(w, nodes, links)
+	}
+	return fmt.Errorf("unsupported graph format '%s'", format)
+}
@@ -0,0 +1,100 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestExportGraph(t *testing.T) {
+	s := NewMemoryStore()
+	for _, key := range []string{"web", `db "main"`, "disk", "unlinked"} {
+		if err, _ := s.SetItem(key, "", `{}`, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err := s.tagValue("web", "env", "prod"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := s.tag("web", "critical"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := s.Link("web", `db "main"`, "depends-on", nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := s.Link(`db "main"`, "disk", "", nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	nodes, links, err := exportGraph(s, "", 0, []string{"env", "critical"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var dot strings.Builder
+	if err = writeDot(&dot, nodes, links); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := `digraph source {
+  "db \"main\"" [label="db \"main\""];
+  "disk" [label="disk"];
+  "web" [label="web\nenv=prod\ncritical"];
+  "db \"main\"" -> "disk";
+  "web" -> "db \"main\"" [label="depends-on"];
+}
+`
+	if dot.String() != expected {
+		t.Fatalf("unexpected dot graph:\n%s", dot.String())
+	}
+	var mermaid strings.Builder
+	if err = writeMermaid(&mermaid, nodes, links); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected = `flowchart TD
+  n0["db #quot;main#quot;"]
+  n1["disk"]
+  n2["web<br/>env=prod<br/>critical"]
+  n0 --> n1
+  n2 -->|"depends-on"| n0
+`
+	if mermaid.String() != expected {
+		t.Fatalf("unexpected mermaid graph:\n%s", mermaid.String())
+	}
+	var graphml strings.Builder
+	if err = writeGraphML(&graphml, nodes, links); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var doc graphML
+	if err = xml.Unmarshal([]byte(graphml.String()), &doc); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(doc.Graph.Nodes) != 3 || len(doc.Graph.Edges) != 2 || doc.Graph.Edges[1].Data[0].Value != "depends-on" {
+		t.Fatalf("unexpected graphml graph:\n%s", graphml.String())
+	}
+	// the descendants of the database only
+	nodes, links, err = exportGraph(s, `db "main"`, 1, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(nodes) != 2 || len(links) != 1 || nodes[1].Key != "disk" {
+		t.Fatalf("unexpected graph %v %v", nodes, links)
+	}
+	// links to missing items, created before link endpoints were validated, are not drawn
+	s.(*memStore).links[linkKey{From: "disk", To: "missing"}] = nil
+	for _, root := range []string{"", `db "main"`} {
+		if nodes, links, err = exportGraph(s, root, 0, nil); err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, l := range links {
+			if l.To == "missing" {
+				t.Fatalf("root '%s': unexpected link to a missing item in %v", root, links)
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"southwinds.dev/source_client"
+	"strings"
+)
+
+// item types can declare indexed fields, whose values are kept in plain text in the item_field table so that filters
+// testing them for equality do not need to decrypt every item of the type
+
+// rowQuerier queries a single row either directly on the database or within a transaction
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// fieldIndexer implemented by stores able to index item fields
+type fieldIndexer interface {
+	// setTypeIndex set the fields indexed for the items of a type, returns true if the error is a validation error
+	setTypeIndex(key string, paths []string) (error, bool)
+	// getTypeIndex get the fields indexed for the items of a type as JSON Pointers
+	getTypeIndex(key string) ([]string, error)
+}
+
+// typeIndex the JSON Pointers of the fields indexed for a type
+func typeIndex(ctx context.Context, q rowQuerier, iType string) ([]string, error) {
+	var indexed sql.NullString
+	err := q.QueryRowContext(ctx, `SELECT indexed FROM type WHERE key = ?;`, iType).Scan(&indexed)
+	if err == sql.ErrNoRows {
+		return nil, ErrItemTypeNotFound
+	}
+	if err != nil || !indexed.Valid {
+		return nil, err
+	}
+	var pointers []string
+	if err = json.Unmarshal([]byte(indexed.String), &pointers); err != nil {
+		return nil, fmt.Errorf("cannot read indexed fields of type %s: %s", iType, err)
+	}
+	return pointers, nil
+}
+
+// indexFields replaces the indexed field values of an item
+func indexFields(ctx context.Context, tx *sqlTx, key, iType string, value []byte) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item_field WHERE item_key = ?;`, key); err != nil {
+		return err
+	}
+	if len(iType) == 0 {
+		return nil
+	}
+	pointers, err := typeIndex(ctx, tx, iType)
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+	var doc interface{}
+	if err = json.Unmarshal(value, &doc); err != nil {
+		return err
+	}
+	for _, pointer := range pointers {
+		path, _ := parsePointer(pointer)
+		v, found := resolvePath(doc, path)
+		if !found {
+			continue
+		}
+		canonical, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.ExecContext(ctx, `INSERT INTO item_field(item_key, pointer, value) VALUES(?, ?, ?);`, key, pointer, string(canonical)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTypeIndex sets the fields indexed for the items of a type and indexes the existing items
+// fields marked as secret by the type schema, or containing secret fields, cannot be indexed as indexed values are not
+// encrypted
+func (d *DataBase) setTypeIndex(key string, paths []string) (error, bool) {
+	t, err := d.getTypeInfo(key)
+	if err != nil {
+		return err, false
+	}
+	secrets, err := secretPaths(t.Schema)
+	if err != nil {
+		return err, false
+	}
+	pointers := []string{}
+	for _, p := range paths {
+		path, err := parsePath(p)
+		if err != nil {
+			return err, true
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("cannot index the whole item value"), true
+		}
+		for _, secret := range secrets {
+			if pathsOverlap(path, secret) {
+				return fmt.Errorf("cannot index field '%s' as it is or contains a secret", p), true
+			}
+		}
+		pointers = append(pointers, pointerString(path))
+	}
+	indexed, err := json.Marshal(pointers)
+	if err != nil {
+		return err, false
+	}
+	ctx := context.Background()
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err, false
+	}
+	if _, err = tx.ExecContext(ctx, `UPDATE type SET indexed = ? WHERE key = ?;`, string(indexed), key); err != nil {
+		_ = tx.Rollback()
+		return err, false
+	}
+	// reads the items before indexing them as the transaction holds a single connection
+	rows, err := tx.QueryContext(ctx, `SELECT i.key, i.value, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE i.type = ?;`, key)
+	if err != nil {
+		_ = tx.Rollback()
+		return err, false
+	}
+	type encrypted struct {
+		key            string
+		value, wrapped []byte
+	}
+	var items []encrypted
+	for rows.Next() {
+		var e encrypted
+		if err = rows.Scan(&e.key, &e.value, &e.wrapped); err != nil {
+			break
+		}
+		items = append(items, e)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	_ = rows.Close()
+	if err != nil {
+		_ = tx.Rollback()
+		return err, false
+	}
+	for _, i := range items {
+		value, err := openValue(i.key, key, i.wrapped, i.value)
+		if err == nil {
+			err = indexFields(ctx, tx, i.key, key, value)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("cannot index item %s: %s", i.key, err), false
+		}
+	}
+	return tx.Commit(), false
+}
+
+// unindexSecrets stops indexing the fields of a type that its schema marks as secret, or that contain secrets, and
+// deletes their indexed values, as indexed values are not encrypted
+func unindexSecrets(ctx context.Context, tx *sqlTx, key string, schema []byte) error {
+	pointers, err := typeIndex(ctx, tx, key)
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+	secrets, err := secretPaths(schema)
+	if err != nil || len(secrets) == 0 {
+		return err
+	}
+	kept := []string{}
+	for _, pointer := range pointers {
+		path, _ := parsePointer(pointer)
+		secret := false
+		for _, s := range secrets {
+			if pathsOverlap(path, s) {
+				secret = true
+				break
+			}
+		}
+		if !secret {
+			kept = append(kept, pointer)
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, `DELETE FROM item_field WHERE pointer = ? AND item_key IN (SELECT key FROM item WHERE type = ?);`, pointer, key); err != nil {
+			return err
+		}
+	}
+	if len(kept) == len(pointers) {
+		return nil
+	}
+	indexed, err := json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE type SET indexed = ? WHERE key = ?;`, string(indexed), key)
+	return err
+}
+
+// getTypeIndex get the fields indexed for the items of a type
+func (d *DataBase) getTypeIndex(key string) ([]string, error) {
+	pointers, err := typeIndex(context.Background(), d.db, key)
+	if err != nil {
+		return nil, err
+	}
+	if pointers == nil {
+		pointers = []string{}
+	}
+	return pointers, nil
+}
+
+// getFilterCandidates get the items of a type, or all items if no type is specified, that may satisfy a filter;
+// equality predicates on the indexed fields of the type narrow the items down but the filter must still be applied
+func (d *DataBase) getFilterCandidates(iType string, f valueFilter) ([]src.I, error) {
+	query := "SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i"
+	if len(iType) == 0 {
+		return d.queryItems(query + " ORDER BY i.key;")
+	}
+	pointers, err := typeIndex(context.Background(), d.db, iType)
+	if err == ErrItemTypeNotFound {
+		// items can have a type that has since been deleted
+		pointers, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conditions := []string{"i.type = ?"}
+	args := []interface{}{iType}
+	for _, p := range f {
+		pointer := pointerString(p.path)
+		if p.op != "==" || !contains(pointers, pointer) {
+			continue
+		}
+		canonical, err := json.Marshal(p.literal)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM item_field f WHERE f.item_key = i.key AND f.pointer = ? AND f.value = ?)")
+		args = append(args, pointer, string(canonical))
+	}
+	return d.queryItems(query+" WHERE "+strings.Join(conditions, " AND ")+" ORDER BY i.key;", args...)
+}
+
+// pathWithin true if a path is equal to or nested within a pattern path, where "*" in the pattern matches any token
+func pathWithin(path, pattern []string) bool {
+	if len(path) < len(pattern) {
+		return false
+	}
+	for i, token := range pattern {
+		if token != "*" && token != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// pathsOverlap true if either path is equal to or nested within the other, where "*" in either path matches any token
+func pathsOverlap(a, b []string) bool {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != "*" && b[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
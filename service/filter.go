@@ -0,0 +1,303 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"southwinds.dev/source_client"
+	"strconv"
+	"strings"
+)
+
+// valuePredicate a condition on the value of an item at a path, for example:
+//
+//	$.region == "eu"
+//	/replicas >= 3
+//	$.tags contains 'pci'
+//	$.owner exists
+//
+// paths are either JSON Pointers or JSONPath expressions made of member names and array indices
+type valuePredicate struct {
+	path []string
+	op   string
+	// literal the decoded json value compared with the value at the path
+	literal interface{}
+}
+
+// valueFilter a conjunction of predicates on item values
+type valueFilter []*valuePredicate
+
+// predicateOps the supported operators, longest first so that prefixes are matched last
+var predicateOps = []string{"==", "!=", "<=", ">=", "<", ">", "contains", "exists"}
+
+// parseValueFilter parses the predicates of a filter, all of which must match
+func parseValueFilter(predicates []string) (valueFilter, error) {
+	var f valueFilter
+	for _, p := range predicates {
+		predicate, err := parsePredicate(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter '%s': %s", p, err)
+		}
+		f = append(f, predicate)
+	}
+	return f, nil
+}
+
+func parsePredicate(s string) (*valuePredicate, error) {
+	s = strings.TrimSpace(s)
+	// the path ends at the first white space or operator character outside brackets
+	end, brackets := len(s), 0
+	for i, r := range s {
+		if r == '[' {
+			brackets++
+		} else if r == ']' && brackets > 0 {
+			brackets--
+		} else if brackets == 0 && (r == ' ' || r == '\t' || strings.ContainsRune("=!<>", r)) {
+			end = i
+			break
+		}
+	}
+	if end == 0 || end == len(s) {
+		return nil, fmt.Errorf("expected a path followed by an operator")
+	}
+	path, err := parsePath(s[:end])
+	if err != nil {
+		return nil, err
+	}
+	rest := strings.TrimSpace(s[end:])
+	for _, op := range predicateOps {
+		if !strings.HasPrefix(rest, op) {
+			continue
+		}
+		operand := rest[len(op):]
+		// word operators must be followed by white space
+		if (op == "contains" || op == "exists") && len(operand) > 0 && operand[0] != ' ' && operand[0] != '\t' {
+			continue
+		}
+		operand = strings.TrimSpace(operand)
+		if op == "exists" {
+			if len(operand) > 0 {
+				return nil, fmt.Errorf("exists does not take an operand")
+			}
+			return &valuePredicate{path: path, op: op}, nil
+		}
+		if len(operand) == 0 {
+			return nil, fmt.Errorf("operator %s requires an operand", op)
+		}
+		return &valuePredicate{path: path, op: op, literal: parseLiteral(operand)}, nil
+	}
+	return nil, fmt.Errorf("expected one of the operators %s", strings.Join(predicateOps, ", "))
+}
+
+// parseLiteral decodes an operand as json, a single-quoted string or otherwise as a bare string
+func parseLiteral(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// parsePath parses a JSON Pointer (/a/0/b) or a JSONPath expression ($.a[0].b or $['a'][0]['b']) into its tokens
+func parsePath(s string) ([]string, error) {
+	if len(s) == 0 || s[0] == '/' {
+		return parsePointer(s)
+	}
+	if s[0] != '$' {
+		return nil, fmt.Errorf("path '%s' is neither a JSON Pointer nor a JSONPath expression", s)
+	}
+	var tokens []string
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case '.':
+			j := i + 1
+			for j < len(s) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("empty member name at position %d of '%s'", i+1, s)
+			}
+			tokens = append(tokens, s[i+1:j])
+			i = j
+		case '[':
+			j := strings.IndexByte(s[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated bracket in '%s'", s)
+			}
+			inner := s[i+1 : i+j]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				tokens = append(tokens, inner[1:len(inner)-1])
+			} else if _, err := strconv.Atoi(inner); err == nil {
+				tokens = append(tokens, inner)
+			} else {
+				return nil, fmt.Errorf("unsupported selector [%s] in '%s'", inner, s)
+			}
+			i += j + 1
+		default:
+			return nil, fmt.Errorf("unexpected '%c' at position %d of '%s'", s[i], i+1, s)
+		}
+	}
+	return tokens, nil
+}
+
+// parsePointer parses a JSON Pointer (RFC 6901) into its reference tokens
+func parsePointer(s string) ([]string, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	if s[0] != '/' {
+		return nil, fmt.Errorf("JSON Pointer '%s' must start with /", s)
+	}
+	tokens := strings.Split(s[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// pointerString formats reference tokens as a JSON Pointer
+func pointerString(tokens []string) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(t, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// resolvePath gets the value at a path of a decoded json document
+func resolvePath(doc interface{}, path []string) (interface{}, bool) {
+	node := doc
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			v, ok := n[token]
+			if !ok {
+				return nil, false
+			}
+			node = v
+		case []interface{}:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+		default:
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// matches true if a decoded json document satisfies the predicate
+func (p *valuePredicate) matches(doc interface{}) bool {
+	v, found := resolvePath(doc, p.path)
+	switch p.op {
+	case "exists":
+		return found
+	case "==":
+		return found && reflect.DeepEqual(v, p.literal)
+	case "!=":
+		return !found || !reflect.DeepEqual(v, p.literal)
+	case "contains":
+		if !found {
+			return false
+		}
+		switch t := v.(type) {
+		case string:
+			s, ok := p.literal.(string)
+			return ok && strings.Contains(t, s)
+		case []interface{}:
+			for _, e := range t {
+				if reflect.DeepEqual(e, p.literal) {
+					return true
+				}
+			}
+		case map[string]interface{}:
+			if s, ok := p.literal.(string); ok {
+				_, exists := t[s]
+				return exists
+			}
+		}
+		return false
+	default:
+		if !found {
+			return false
+		}
+		c, ok := compareJson(v, p.literal)
+		if !ok {
+			return false
+		}
+		switch p.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}
+}
+
+// compareJson orders two numbers or two strings, returns false if the values are not comparable
+func compareJson(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+// matches true if an item value satisfies all the predicates of the filter
+func (f valueFilter) matches(value []byte) bool {
+	var doc interface{}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return false
+	}
+	for _, p := range f {
+		if !p.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns the items whose value satisfies the filter
+func (f valueFilter) apply(items []src.I) []src.I {
+	var result []src.I
+	for _, item := range items {
+		if f.matches(item.Value) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -0,0 +1,173 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValueFilter(t *testing.T) {
+	value := []byte(`{"region":"eu","replicas":3,"tags":["pci","web"],"db":{"host":"pg","port":5432},"a/b":true}`)
+	cases := map[string]bool{
+		`$.region == "eu"`:        true,
+		`$.region == 'eu'`:        true,
+		`$.region==eu`:            true,
+		`/region != "us"`:         true,
+		`$.missing != 1`:          true,
+		`$.replicas >= 3`:         true,
+		`$.replicas > 3`:          false,
+		`$.replicas < "4"`:        false,
+		`$.tags contains 'pci'`:   true,
+		`$.tags[1] == "web"`:      true,
+		`$['db']['port'] <= 5432`: true,
+		`/db/host contains p`:     true,
+		`$.db contains "host"`:    true,
+		`/a~1b == true`:           true,
+		`$.owner exists`:          false,
+		`$.db.host exists`:        true,
+	}
+	for predicate, expected := range cases {
+		f, err := parseValueFilter([]string{predicate})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if f.matches(value) != expected {
+			t.Fatalf("%s: expected %t", predicate, expected)
+		}
+	}
+	for _, predicate := range []string{`region == "eu"`, `$.region`, `$.region ~ 1`, `$.region ==`, `$..x == 1`, `$.owner exists 1`, `$.tags containsx`} {
+		if _, err := parseValueFilter([]string{predicate}); err == nil {
+			t.Fatalf("expected %s to be rejected", predicate)
+		}
+	}
+}
+
+func TestFilterIndex(t *testing.T) {
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	schema := []byte(`{"type":"object","properties":{"region":{"type":"string"},"password":{"type":"string","x-secret":true}}}`)
+	if err = d.setTypeFromString("kv", schema, []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for key, region := range map[string]string{"a": "eu", "b": "us", "c": "eu"} {
+		if err, _ = d.SetItem(key, "kv", `{"region":"`+region+`","password":"x"}`, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if err, isValidationError := d.setTypeIndex("kv", []string{"$.password"}); err == nil || !isValidationError {
+		t.Fatalf("expected secret fields not to be indexable")
+	}
+	// existing items are indexed when the index is set
+	if err, _ = d.setTypeIndex("kv", []string{"$.region"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// new items are indexed when written
+	if err, _ = d.SetItem("b", "kv", `{"region":"eu"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	f, _ := parseValueFilter([]string{`$.region == "eu"`})
+	items, err := d.getFilterCandidates("kv", f)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var keys []string
+	for _, i := range items {
+		keys = append(keys, i.Key)
+	}
+	if strings.Join(keys, ",") != "a,b,c" {
+		t.Fatalf("unexpected candidates %v", keys)
+	}
+	f, _ = parseValueFilter([]string{`/region == "us"`})
+	if items, err = d.getFilterCandidates("kv", f); err != nil || len(items) != 0 {
+		t.Fatalf("expected no candidates, got %v (%v)", items, err)
+	}
+	// fields marked as secret by a new schema are no longer indexed
+	schema = []byte(`{"type":"object","properties":{"region":{"type":"string","x-secret":true},"password":{"type":"string","x-secret":true}}}`)
+	if err = d.setTypeFromString("kv", schema, []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if pointers, _ := d.getTypeIndex("kv"); len(pointers) != 0 {
+		t.Fatalf("expected secret fields not to be indexed, got %v", pointers)
+	}
+	if count := indexedValues(t, d); count != 0 {
+		t.Fatalf("expected the values of secret fields to be deleted, got %d", count)
+	}
+	// the indexed values of the items of a deleted type are deleted
+	schema = []byte(`{"type":"object","properties":{"region":{"type":"string"}}}`)
+	if err = d.setTypeFromString("kv", schema, []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.setTypeIndex("kv", []string{"$.region"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := indexedValues(t, d); count != 3 {
+		t.Fatalf("expected 3 indexed values, got %d", count)
+	}
+	if err = d.DeleteType("kv"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if count := indexedValues(t, d); count != 0 {
+		t.Fatalf("expected the indexed values to be deleted with the type, got %d", count)
+	}
+}
+
+func TestIndexSecretAncestors(t *testing.T) {
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	schema := []byte(`{"type":"object","properties":{"db":{"type":"object","properties":{"password":{"x-secret":true}}},"users":{"type":"array","items":{"properties":{"token":{"x-secret":true}}}}}}`)
+	if err = d.setTypeFromString("app", schema, []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("a", "app", `{"db":{"host":"h","password":"hunter2"},"users":[{"name":"u","token":"t"}]}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// fields containing secrets, including through wildcards, cannot be indexed
+	for _, path := range []string{"$.db", "/users", "/users/0", "/users/0/token"} {
+		if err, isValidationError := d.setTypeIndex("app", []string{path}); err == nil || !isValidationError {
+			t.Fatalf("expected %s not to be indexable, got %v", path, err)
+		}
+	}
+	if count := indexedValues(t, d); count != 0 {
+		t.Fatalf("expected no indexed values, got %d", count)
+	}
+	if err, _ = d.setTypeIndex("app", []string{"/db/host", "/users/0/name"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// marking a nested field as secret stops indexing the fields containing it
+	if err = d.setTypeFromString("app", []byte(`{"type":"object","properties":{"db":{"type":"object","properties":{"password":{"x-secret":true}}}}}`), []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.setTypeIndex("app", []string{"/db/host", "/users"}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = d.setTypeFromString("app", schema, []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if pointers, _ := d.getTypeIndex("app"); fmt.Sprint(pointers) != "[/db/host]" {
+		t.Fatalf("expected the fields containing secrets not to be indexed, got %v", pointers)
+	}
+	if count := indexedValues(t, d); count != 1 {
+		t.Fatalf("expected the values of the fields containing secrets to be deleted, got %d values", count)
+	}
+}
+
+// indexedValues the number of indexed field values in a database
+func indexedValues(t *testing.T, d *DataBase) int {
+	var count int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM item_field;`).Scan(&count); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return count
+}
@@ -0,0 +1,250 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"southwinds.dev/source_client"
+	"strings"
+)
+
+// Graph the items reachable from an item by following links, either from parents to children (descendants) or from
+// children to parents (ancestors)
+type Graph struct {
+	// Root the key of the item the traversal started from
+	Root string `json:"root"`
+	// Items the items reached including the root, ordered by depth and key
+	Items []GraphItem `json:"items"`
+	// Links the links traversed, always from parent to child
+	Links []Link `json:"links"`
+	// Cycles the cycles found amongst the links traversed, each as the keys of the items in the cycle starting and
+	// ending with the same key
+	Cycles [][]string `json:"cycles,omitempty"`
+}
+
+// GraphItem an item reached by a graph traversal
+type GraphItem struct {
+	src.I
+	// Depth the number of links between the item and the root
+	Depth int `json:"depth"`
+}
+
+// newGraph builds a graph from the items and links collected by a traversal, computing the depth of each item and
+// the cycles amongst the links
+func newGraph(root string, ancestors bool, items []src.I, links []Link) *Graph {
+	// follows links in the direction of the traversal, once for items linked by several kinds of relationship
+	next := map[string][]string{}
+	seen := map[[2]string]bool{}
+	for _, l := range links {
+		from, to := l.From, l.To
+		if ancestors {
+			from, to = to, from
+		}
+		if !seen[[2]string{from, to}] {
+			seen[[2]string{from, to}] = true
+			next[from] = append(next[from], to)
+		}
+	}
+	for _, n := range next {
+		sort.Strings(n)
+	}
+	// shortest distance from the root
+	depth := map[string]int{root: 0}
+	queue := []string{root}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for _, n := range next[key] {
+			if _, seen := depth[n]; !seen {
+				depth[n] = depth[key] + 1
+				queue = append(queue, n)
+			}
+		}
+	}
+	g := &Graph{Root: root, Items: []GraphItem{}, Links: links, Cycles: findCycles(root, next)}
+	if g.Links == nil {
+		g.Links = []Link{}
+	}
+	for _, i := range items {
+		g.Items = append(g.Items, GraphItem{I: i, Depth: depth[i.Key]})
+	}
+	sort.Slice(g.Items, func(i, j int) bool {
+		if g.Items[i].Depth != g.Items[j].Depth {
+			return g.Items[i].Depth < g.Items[j].Depth
+		}
+		return g.Items[i].Key < g.Items[j].Key
+	})
+	sort.Slice(g.Links, sortLinks(g.Links))
+	return g
+}
+
+// findCycles finds the cycles reachable from the root with a depth first search, reporting one cycle per link
+// closing back onto the current path
+func findCycles(root string, next map[string][]string) [][]string {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	var (
+		cycles [][]string
+		path   []string
+		state  = map[string]int{}
+		visit  func(key string)
+	)
+	visit = func(key string) {
+		state[key] = visiting
+		path = append(path, key)
+		for _, n := range next[key] {
+			switch state[n] {
+			case visiting:
+				// the path from n to key plus the link back to n
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == n {
+						cycle := append(append([]string{}, path[i:]...), n)
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			case 0:
+				visit(n)
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = done
+	}
+	visit(root)
+	return cycles
+}
+
+// reachCTE the recursive common table expression "reach(key, depth)" selecting the items reachable from an item by
+// following links of the specified kinds up to a depth, zero meaning no limit, along with the arguments it binds
+// UNION discards rows already produced, which stops the recursion when it meets a cycle
+func reachCTE(key string, ancestors bool, depth int, kinds linkKinds) (string, []interface{}) {
+	from, to := "from_key", "to_key"
+	if ancestors {
+		from, to = to, from
+	}
+	args := []interface{}{key}
+	// without a limit depth is constant so that each item is produced once
+	step := "0"
+	var conditions []string
+	if depth > 0 {
+		step = "r.depth + 1"
+		conditions = append(conditions, "r.depth < ?")
+		args = append(args, depth)
+	}
+	kindConditions, kindArgs := kinds.conditions()
+	conditions = append(conditions, kindConditions...)
+	args = append(args, kindArgs...)
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return `WITH RECURSIVE reach(key, depth) AS (
+	SELECT CAST(? AS TEXT), 0
+	UNION
+	SELECT l.` + to + `, ` + step + ` FROM reach r INNER JOIN link l ON l.` + from + ` = r.key` + where + `
+) `, args
+}
+
+// getGraph get the descendants or ancestors of an item following links of the specified kinds up to the specified
+// depth, zero meaning no limit
+func (d *DataBase) getGraph(key string, ancestors bool, depth int, kinds linkKinds) (*Graph, error) {
+	if _, _, err := d.getItemStamp(key); err != nil {
+		return nil, err
+	}
+	cte, args := reachCTE(key, ancestors, depth, kinds)
+	items, err := d.queryItems(cte+"SELECT i.key, i.type, i.value, i.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = i.key) FROM item i WHERE i.key IN (SELECT key FROM reach);", args...)
+	if err != nil {
+		return nil, err
+	}
+	// the links leaving the items within the depth limit towards reached items
+	from, to := "from_key", "to_key"
+	if ancestors {
+		from, to = to, from
+	}
+	edgeArgs := append([]interface{}{}, args...)
+	within := "SELECT key FROM reach"
+	if depth > 0 {
+		within += " WHERE depth < ?"
+		edgeArgs = append(edgeArgs, depth)
+	}
+	conditions := []string{"l." + from + " IN (" + within + ")", "l." + to + " IN (SELECT key FROM reach)"}
+	kindConditions, kindArgs := kinds.conditions()
+	conditions = append(conditions, kindConditions...)
+	edgeArgs = append(edgeArgs, kindArgs...)
+	rows, err := d.db.Query(cte+"SELECT l.from_key, l.to_key, l.rel, l.attributes FROM link l WHERE "+strings.Join(conditions, " AND ")+";", edgeArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}()
+	var links []Link
+	for rows.Next() {
+		var (
+			l          Link
+			attributes sql.NullString
+		)
+		if err = rows.Scan(&l.From, &l.To, &l.Rel, &attributes); err != nil {
+			return nil, err
+		}
+		if attributes.Valid {
+			l.Attributes = json.RawMessage(attributes.String)
+		}
+		links = append(links, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return newGraph(key, ancestors, items, links), nil
+}
+
+func (m *memStore) getGraph(key string, ancestors bool, depth int, kinds linkKinds) (*Graph, error) {
+	m.lock.RLock()
+	if _, exists := m.items[key]; !exists {
+		m.lock.RUnlock()
+		return nil, ErrNotFound
+	}
+	reached := map[string]int{key: 0}
+	queue := []string{key}
+	var links []Link
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		if depth > 0 && reached[k] >= depth {
+			continue
+		}
+		for l, attributes := range m.links {
+			from, to := l.From, l.To
+			if ancestors {
+				from, to = to, from
+			}
+			if from != k || !kinds.follows(l.Rel) {
+				continue
+			}
+			links = append(links, Link{From: l.From, To: l.To, Rel: l.Rel, Attributes: copyBytes(attributes)})
+			if _, seen := reached[to]; !seen {
+				reached[to] = reached[k] + 1
+				queue = append(queue, to)
+			}
+		}
+	}
+	m.lock.RUnlock()
+	items := m.selectItems(func(i *memItem) bool {
+		_, ok := reached[i.item.Key]
+		return ok
+	})
+	return newGraph(key, ancestors, items, links), nil
+}
@@ -0,0 +1,71 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGraph(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// env -> cluster -> service-a -> component
+			//            \-> service-b -> component -> service-b (cycle)
+			for _, key := range []string{"env", "cluster", "service-a", "service-b", "component", "other"} {
+				if err, _ := s.SetItem(key, "", `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			for _, l := range [][2]string{{"env", "cluster"}, {"cluster", "service-a"}, {"cluster", "service-b"}, {"service-a", "component"}, {"service-b", "component"}, {"component", "service-b"}} {
+				if err := s.Link(l[0], l[1], "", nil); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			describe := func(g *Graph) string {
+				var items, links, cycles []string
+				for _, i := range g.Items {
+					items = append(items, fmt.Sprintf("%s:%d", i.Key, i.Depth))
+				}
+				for _, l := range g.Links {
+					links = append(links, l.From+">"+l.To)
+				}
+				for _, c := range g.Cycles {
+					cycles = append(cycles, strings.Join(c, ">"))
+				}
+				return strings.Join(items, ",") + " " + strings.Join(links, ",") + " " + strings.Join(cycles, ",")
+			}
+			cases := []struct {
+				key       string
+				ancestors bool
+				depth     int
+				expected  string
+			}{
+				{"env", false, 0, "env:0,cluster:1,service-a:2,service-b:2,component:3 cluster>service-a,cluster>service-b,component>service-b,env>cluster,service-a>component,service-b>component component>service-b>component"},
+				{"env", false, 2, "env:0,cluster:1,service-a:2,service-b:2 cluster>service-a,cluster>service-b,env>cluster "},
+				{"component", true, 0, "component:0,service-a:1,service-b:1,cluster:2,env:3 cluster>service-a,cluster>service-b,component>service-b,env>cluster,service-a>component,service-b>component component>service-b>component"},
+				{"component", true, 1, "component:0,service-a:1,service-b:1 service-a>component,service-b>component "},
+				{"other", false, 0, "other:0  "},
+			}
+			for _, c := range cases {
+				g, err := s.getGraph(c.key, c.ancestors, c.depth, allLinks)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				if actual := describe(g); actual != c.expected {
+					t.Fatalf("graph of %s (ancestors %t, depth %d):\nexpected %s\ngot      %s", c.key, c.ancestors, c.depth, c.expected, actual)
+				}
+			}
+			if _, err := s.getGraph("missing", false, 0, allLinks); err != ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		})
+	}
+}
@@ -10,15 +10,18 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	h "southwinds.dev/http"
 	_ "southwinds.dev/source/docs"
 	"southwinds.dev/source_client"
+	"strconv"
 	"strings"
 )
 
@@ -50,16 +53,46 @@ func ReadyHandler(w http.ResponseWriter, r *http.Request) {
 
 // SetTypeHandler
 // @Summary Set the validation for an item type
-// @Description Set the json schema to validate an item of the specific type
+// @Description Set the json schema to validate an item of the specific type. A new version of the type is recorded
+// @Description when the schema changes. The new schema is checked for compatibility with the current one: backward
+// @Description (existing items remain valid), forward (the current schema accepts new items) or full (both), and
+// @Description breaking changes are rejected unless forced.
+// @Description With dryRun the schema is not set, the breaking changes and the existing items that would fail
+// @Description validation are reported instead.
 // @Tags Validation
 // @Router /type [put]
 // @Param schema body src.TT true "the json schema to apply to the item type and an example prototype"
+// @Param compatibility query string false "the compatibility check: backward (default), forward, full or none"
+// @Param force query boolean false "set the schema even if it breaks compatibility"
+// @Param dryRun query boolean false "report the impact of the schema without setting it"
 // @Accepts json
 // @Produce json
 // @Failure 400 {string} the request is not correct
+// @Failure 409 {string} the schema is not compatible with the current schema of the type
 // @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} ValidationReport "the impact of the schema, for a dry run"
 // @Success 204 {string} the request was successful
 func SetTypeHandler(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("compatibility")
+	if len(mode) == 0 {
+		mode = compatBackward
+	}
+	if !contains(compatibilityModes, mode) {
+		log.Printf("invalid compatibility '%s'\n", mode)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid compatibility '%s', expected one of %s\n", mode, strings.Join(compatibilityModes, ", ")))
+		return
+	}
+	flags := map[string]bool{"force": false, "dryRun": false}
+	for name := range flags {
+		if value := r.URL.Query().Get(name); len(value) > 0 {
+			var err error
+			if flags[name], err = strconv.ParseBool(value); err != nil {
+				log.Printf("invalid %s flag '%s'\n", name, value)
+				h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid %s flag '%s', expected true or false\n", name, value))
+				return
+			}
+		}
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("cannot read request body: %s\n", err)
@@ -73,12 +106,39 @@ func SetTypeHandler(w http.ResponseWriter, r *http.Request) {
 		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot unmarshal request body: %s\n", err))
 		return
 	}
-	err = db.setTypeFromString(t.Key, t.Schema, t.Proto)
+	if flags["dryRun"] {
+		report, err := previewType(db, t.Key, t.Schema, mode)
+		if err != nil {
+			if errors.Is(err, ErrInvalidSchema) {
+				log.Printf("cannot preview type: %s\n", err)
+				h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot preview type: %s\n", err))
+				return
+			}
+			log.Printf("cannot preview type: %s\n", err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot preview type: %s\n", err))
+			return
+		}
+		h.Write(w, r, report)
+		return
+	}
+	breaking, err := setType(db, t.Key, t.Schema, t.Proto, mode, flags["force"])
 	if err != nil {
-		log.Printf("cannot set type: %s\n", err)
-		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot set type: %s\n", err))
+		switch {
+		case errors.Is(err, ErrInvalidSchema):
+			log.Printf("cannot set type: %s\n", err)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot set type: %s\n", err))
+		case err == ErrIncompatibleSchema:
+			log.Printf("cannot set type %s: %s: %s\n", t.Key, err, strings.Join(breaking, "; "))
+			h.Err(w, http.StatusConflict, fmt.Sprintf("cannot set type %s: %s, use force=true to set it anyway: %s\n", t.Key, err, strings.Join(breaking, "; ")))
+		default:
+			log.Printf("cannot set type: %s\n", err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot set type: %s\n", err))
+		}
 		return
 	}
+	if len(breaking) > 0 {
+		log.Printf("forced %s change of type %s: %s\n", ErrIncompatibleSchema, t.Key, strings.Join(breaking, "; "))
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -127,6 +187,92 @@ func GetTypesHandler(w http.ResponseWriter, r *http.Request) {
 	h.Write(w, r, types)
 }
 
+// GetTypeVersionsHandler
+// @Summary Get the versions of an item type
+// @Description Get the versions of the json schema of an item type, newest first, along with the number of items
+// @Description last validated against each version
+// @Tags Validation
+// @Router /type/{key}/version [get]
+// @Param key path string true "the key for the item type"
+// @Produce json
+// @Failure 404 {string} item type not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {array} TypeVersion
+func GetTypeVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	versions, err := db.getTypeVersions(key)
+	if err != nil {
+		if err == ErrItemTypeNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get versions of type %s: %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get versions of type %s: %s\n", key, err))
+		return
+	}
+	h.Write(w, r, versions)
+}
+
+// GetTypeVersionHandler
+// @Summary Get a version of an item type
+// @Description Get a version of the json schema of an item type
+// @Tags Validation
+// @Router /type/{key}/version/{version} [get]
+// @Param key path string true "the key for the item type"
+// @Param version path integer true "the version number"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} version not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} TypeVersion
+func GetTypeVersionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	version, err := strconv.ParseInt(vars["version"], 10, 64)
+	if err != nil || version < 1 {
+		log.Printf("invalid version '%s'\n", vars["version"])
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid version '%s'\n", vars["version"]))
+		return
+	}
+	v, err := db.getTypeVersion(key, version)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get version %d of type %s: %s\n", version, key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get version %d of type %s: %s\n", version, key, err))
+		return
+	}
+	h.Write(w, r, v)
+}
+
+// ValidateTypeItemsHandler
+// @Summary Validate the items of a type
+// @Description Validate the items of a type against the current schema of the type, e.g. after the schema was forced
+// @Description to change, and report the items failing validation with all their errors
+// @Tags Validation
+// @Router /type/{key}/validate-items [post]
+// @Param key path string true "the key for the item type"
+// @Produce json
+// @Failure 404 {string} item type not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} ValidationReport
+func ValidateTypeItemsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	report, err := validateItems(db, key)
+	if err != nil {
+		if err == ErrItemTypeNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot validate items of type %s: %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot validate items of type %s: %s\n", key, err))
+		return
+	}
+	h.Write(w, r, report)
+}
+
 // DeleteTypeHandler
 // @Summary Delete a configuration type
 // @Description Delete a configuration type
@@ -149,6 +295,122 @@ func DeleteTypeHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// SetTypeRetentionHandler
+// @Summary Set the revision retention for an item type
+// @Description Set the number of revisions kept for each item of the specified type, zero keeps all revisions
+// @Tags Validation
+// @Router /type/{key}/retention/{count} [put]
+// @Param key path string true "the key for the item type"
+// @Param count path integer true "the number of revisions to keep"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} item type not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 204 {string} the request was successful
+func SetTypeRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	count, err := strconv.Atoi(vars["count"])
+	if err != nil || count < 0 {
+		log.Printf("invalid retention count '%s'\n", vars["count"])
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid retention count '%s'\n", vars["count"]))
+		return
+	}
+	err = db.setTypeRetention(key, count)
+	if err != nil {
+		if err == ErrItemTypeNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot set retention for type '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot set retention for type '%s': %s\n", key, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetTypeIndexHandler
+// @Summary Set the indexed fields of an item type
+// @Description Set the fields of the items of a type that are indexed to speed up filters testing them for equality,
+// @Description the values of indexed fields are kept in plain text so fields marked as secret cannot be indexed
+// @Tags Validation
+// @Router /type/{key}/index [put]
+// @Param key path string true "the key for the item type"
+// @Param fields body []string true "the JSON Pointer or JSONPath expressions of the fields to index, an empty list removes all indexes"
+// @Accepts json
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} item type not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not index item fields
+// @Success 204 {string} the request was successful
+func SetTypeIndexHandler(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := db.(fieldIndexer)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not index item fields\n")
+		return
+	}
+	key := mux.Vars(r)["key"]
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("cannot read request body: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot read request body: %s\n", err))
+		return
+	}
+	var fields []string
+	if err = json.Unmarshal(body, &fields); err != nil {
+		log.Printf("cannot unmarshal request body: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot unmarshal request body: %s\n", err))
+		return
+	}
+	err, isValidationError := indexer.setTypeIndex(key, fields)
+	if err != nil {
+		if err == ErrItemTypeNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if isValidationError {
+			log.Printf("cannot index fields of type '%s': %s\n", key, err)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot index fields of type '%s': %s\n", key, err))
+			return
+		}
+		log.Printf("cannot index fields of type '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot index fields of type '%s': %s\n", key, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetTypeIndexHandler
+// @Summary Get the indexed fields of an item type
+// @Description Get the JSON Pointers of the fields indexed for the items of a type
+// @Tags Validation
+// @Router /type/{key}/index [get]
+// @Param key path string true "the key for the item type"
+// @Produce json
+// @Failure 404 {string} item type not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not index item fields
+// @Success 200 {array} string
+func GetTypeIndexHandler(w http.ResponseWriter, r *http.Request) {
+	indexer, ok := db.(fieldIndexer)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not index item fields\n")
+		return
+	}
+	key := mux.Vars(r)["key"]
+	fields, err := indexer.getTypeIndex(key)
+	if err != nil {
+		if err == ErrItemTypeNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get indexed fields of type '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get indexed fields of type '%s': %s\n", key, err))
+		return
+	}
+	h.Write(w, r, fields)
+}
+
 // SetItemHandler
 // @Summary Set the value of a configuration item
 // @Description Set value of a configuration item
@@ -157,30 +419,42 @@ func DeleteTypeHandler(w http.ResponseWriter, r *http.Request) {
 // @Param key path string true "the key for the configuration item to set"
 // @Param schema body string true "the json based configuration"
 // @Param Source-Type header string false "the key that defines the type of item for validation purposes. If not specified, no validation is performed."
+// @Param If-Match header string false "the entity tag of the item version to update, the item is only updated if its current version matches"
 // @Accepts json
 // @Produce json
-// @Failure 400 {string} the request is not correct
+// @Failure 400 {object} ValidationFailure "the request is not correct, with all the errors found if the value does not satisfy the schema of the item type"
+// @Failure 412 {string} the item version does not match the If-Match header
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 204 {string} the request was successful
 func SetItemHandler(w http.ResponseWriter, r *http.Request) {
 	itemType := r.Header.Get("Source-Type")
 	vars := mux.Vars(r)
 	key := vars["key"]
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		log.Printf("cannot set item '%s': %s\n", key, err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot set item '%s': %s\n", key, err))
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("cannot read request body: %s\n", err)
 		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot read request body: %s\n", err))
 		return
 	}
-	err, isValidationError := db.SetItem(key, itemType, string(body[:]))
+	err, isValidationError := db.SetItem(key, itemType, string(body[:]), version)
 	if err != nil {
-		if err == ErrItemTypeNotFound {
+		if err == ErrVersionMismatch {
+			log.Printf("cannot set item '%s': %s\n", key, err)
+			h.Err(w, http.StatusPreconditionFailed, fmt.Sprintf("cannot set item '%s': %s\n", key, err))
+			return
+		} else if err == ErrItemTypeNotFound {
 			log.Printf("cannot set item '%s': %s\n", key, err)
 			h.Err(w, http.StatusBadRequest, fmt.Sprintf("item type %s is not defined for item %s\n", itemType, key))
 			return
 		} else if isValidationError {
 			log.Printf("cannot set item '%s': %s\n", key, err)
-			h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot set item '%s' due to a schema validation error: %s\n", key, err))
+			writeValidationErrors(w, r, fmt.Sprintf("cannot set item '%s' due to a schema validation error", key), err)
 			return
 		}
 		log.Printf("cannot set item '%s': %s\n", key, err)
@@ -190,31 +464,243 @@ func SetItemHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ValidationFailure the body of the responses to requests writing item values that fail validation
+type ValidationFailure struct {
+	// Error what could not be done
+	Error string `json:"error"`
+	// Errors all the errors found validating the value
+	Errors []ValidationError `json:"errors"`
+}
+
+// writeValidationErrors writes a bad request response listing the errors found validating an item value as json, or
+// as text if the error is not a validation error
+func writeValidationErrors(w http.ResponseWriter, r *http.Request, message string, err error) {
+	var errs *ValidationErrors
+	if !errors.As(err, &errs) {
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s: %s\n", message, err))
+		return
+	}
+	// the content type must be set before the status is written
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	h.Write(w, r, ValidationFailure{Error: message, Errors: errs.Errors})
+}
+
+// GetItemValueHandler
+// @Summary Get part of the value of a configuration item
+// @Description Get the fragment of the value of a configuration item addressed by a JSON Pointer, e.g.
+// @Description /item/app/value/db/host. Strings, numbers, booleans and null are returned as plain text, objects and
+// @Description arrays as json.
+// @Tags Items
+// @Router /item/{key}/value/{pointer} [get]
+// @Param key path string true "the key for the configuration item"
+// @Param pointer path string true "the JSON Pointer of the fragment without its leading slash, the whole value if empty"
+// @Param If-None-Match header string false "the entity tag of the item version held by the client"
+// @Param If-Modified-Since header string false "the last modification time of the item held by the client"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Produce json
+// @Produce plain
+// @Failure 404 {string} configuration not found or the pointer does not resolve
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {string} the request was successful
+// @Success 304 {string} the item has not been modified
+// @Header 200 {string} ETag "the entity tag of the item version, to be used in If-Match headers"
+// @Header 200 {string} Last-Modified "the time the item was last updated"
+func GetItemValueHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	var path []string
+	if pointer := vars["pointer"]; len(pointer) > 0 {
+		// cannot fail as the pointer starts with a slash
+		path, _ = parsePointer("/" + pointer)
+	}
+	version, updated, err := db.getItemStamp(key)
+	if err == nil && notModified(w, r, itemETag(version, updated, revealsSecrets(r)), updated) {
+		return
+	}
+	item, version, err := db.getVersionedItem(key)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ErrIntegrity) {
+			// the stored value has been tampered with or corrupted
+			log.Printf("integrity check failed for configuration %s: %s\n", key, err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("integrity check failed for configuration %s\n", key))
+			return
+		}
+		log.Printf("cannot get item '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get item '%s': %s\n", key, err))
+		return
+	}
+	masker := newSecretMasker(r)
+	if item.Value, err = masker.mask(item.Type, item.Value); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	doc, err := decodeJson(item.Value)
+	if err != nil {
+		log.Printf("cannot decode item '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot decode item '%s': %s\n", key, err))
+		return
+	}
+	value, found := resolvePath(doc, path)
+	if !found {
+		h.Err(w, http.StatusNotFound, fmt.Sprintf("'%s' not found in item '%s'\n", pointerString(path), key))
+		return
+	}
+	w.Header().Set("ETag", itemETag(version, item.Updated, masker == nil))
+	w.Header().Set("Last-Modified", item.Updated.Format(http.TimeFormat))
+	switch v := value.(type) {
+	case map[string]interface{}, []interface{}:
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(v)
+	case string:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = io.WriteString(w, v)
+	default:
+		// numbers, booleans and null
+		b, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write(b)
+	}
+	if err != nil {
+		log.Printf("cannot write value of item '%s': %s\n", key, err)
+	}
+}
+
+// PatchItemHandler
+// @Summary Update part of the value of a configuration item
+// @Description Apply a JSON Merge Patch (RFC 7386) or a JSON Patch (RFC 6902) to the value of a configuration item,
+// @Description selected by the Content-Type header. The patched value is validated against the schema of the item type.
+// @Description The patch is applied atomically: if the item is updated concurrently the patch is applied again to the
+// @Description new value, unless If-Match is specified.
+// @Tags Items
+// @Router /item/{key} [patch]
+// @Param key path string true "the key for the configuration item to patch"
+// @Param patch body string true "the patch document"
+// @Param Content-Type header string true "application/merge-patch+json or application/json-patch+json"
+// @Param If-Match header string false "the entity tag of the item version to patch, the item is only patched if its current version matches"
+// @Accepts json
+// @Produce json
+// @Failure 400 {object} ValidationFailure "the patch is not valid, or the patched value does not satisfy the schema of the item type with all the errors found"
+// @Failure 404 {string} configuration not found
+// @Failure 409 {string} a test operation of the patch failed
+// @Failure 412 {string} the item version does not match the If-Match header
+// @Failure 415 {string} the patch media type is not supported
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 204 {string} the request was successful
+func PatchItemHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != mergePatchType && mediaType != jsonPatchType) {
+		log.Printf("cannot patch item '%s': unsupported media type '%s'\n", key, r.Header.Get("Content-Type"))
+		h.Err(w, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported media type '%s', expected %s or %s\n", r.Header.Get("Content-Type"), mergePatchType, jsonPatchType))
+		return
+	}
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		log.Printf("cannot patch item '%s': %s\n", key, err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot patch item '%s': %s\n", key, err))
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("cannot read request body: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot read request body: %s\n", err))
+		return
+	}
+	err, isValidationError := patchItem(db, key, mediaType, body, version)
+	if err != nil {
+		log.Printf("cannot patch item '%s': %s\n", key, err)
+		switch {
+		case err == ErrNotFound:
+			w.WriteHeader(http.StatusNotFound)
+		case err == ErrVersionMismatch:
+			h.Err(w, http.StatusPreconditionFailed, fmt.Sprintf("cannot patch item '%s': %s\n", key, err))
+		case errors.Is(err, ErrPatchTestFailed):
+			h.Err(w, http.StatusConflict, fmt.Sprintf("cannot patch item '%s': %s\n", key, err))
+		case errors.Is(err, ErrInvalidPatch):
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot patch item '%s': %s\n", key, err))
+		case isValidationError:
+			writeValidationErrors(w, r, fmt.Sprintf("cannot patch item '%s' due to a schema validation error", key), err)
+		default:
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot patch item: %s\n", err))
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // GetItemHandler
 // @Summary Get the value of a configuration item
 // @Description Get value of a configuration item
 // @Tags Items
 // @Router /item/{key} [get]
 // @Param key path string true "the key for the configuration item to get"
+// @Param If-None-Match header string false "the entity tag of the item version held by the client"
+// @Param If-Modified-Since header string false "the last modification time of the item held by the client"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Param resolve query boolean false "replace the references to other items, e.g. {\"$ref\": \"item://shared-db#/host\"}, by the values they refer to"
 // @Produce json
 // @Failure 400 {string} the request is not correct
 // @Failure 404 {string} configuration not found
+// @Failure 422 {string} a reference cannot be resolved as it is dangling, invalid or part of a cycle
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
+// @Success 304 {string} the item has not been modified
+// @Header 200 {string} ETag "the entity tag of the item version, to be used in If-Match headers"
+// @Header 200 {string} Last-Modified "the time the item was last updated"
 func GetItemHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	item, err := db.getItem(key)
+	resolve := r.URL.Query().Get("resolve") == "true"
+	// checks if the client copy is current without decrypting the item
+	// resolved values also depend on the items referenced so they are not conditional
+	version, updated, err := db.getItemStamp(key)
+	if err == nil && !resolve && notModified(w, r, itemETag(version, updated, revealsSecrets(r)), updated) {
+		return
+	}
+	item, version, err := db.getVersionedItem(key)
 	if err != nil {
 		if err == ErrNotFound {
 			log.Println(err)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, ErrIntegrity) {
+			// the stored value has been tampered with or corrupted
+			log.Printf("integrity check failed for configuration %s: %s\n", key, err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("integrity check failed for configuration %s\n", key))
+			return
+		}
 		log.Printf("cannot get configuration: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get configuration: %s\n", err))
 		return
 	}
+	masker := newSecretMasker(r)
+	if item.Value, err = masker.mask(item.Type, item.Value); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	if resolve {
+		if err = newRefResolver(db, masker).resolveItem(item); err != nil {
+			log.Printf("cannot resolve references of configuration %s: %s\n", key, err)
+			if unresolvable(err) {
+				h.Err(w, http.StatusUnprocessableEntity, fmt.Sprintf("cannot resolve references of configuration %s: %s\n", key, err))
+				return
+			}
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot resolve references of configuration %s: %s\n", key, err))
+			return
+		}
+	} else {
+		w.Header().Set("ETag", itemETag(version, item.Updated, masker == nil))
+		w.Header().Set("Last-Modified", item.Updated.Format(http.TimeFormat))
+	}
 	h.Write(w, r, item)
 }
 
@@ -223,16 +709,77 @@ func GetItemHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Get all the configurations
 // @Tags Items
 // @Router /item [get]
+// @Param filter query []string false "predicates on the item values that must all match, e.g. $.region == 'eu', /replicas >= 3, $.tags contains 'pci' or $.owner exists; paths are JSONPath or JSON Pointer expressions" collectionFormat(multi)
+// @Param fields query []string false "the fields to keep in the item values as comma separated JSONPath or JSON Pointer paths (e.g. /name,$.db.host), other fields are removed" collectionFormat(multi)
+// @Param tags query string false "a tag expression selecting the items, e.g. env=prod AND (team=payments OR critical) AND NOT deprecated; names and values can be double-quoted"
+// @Param If-None-Match header string false "the entity tag of the collection held by the client, ignored when filtering by tags"
+// @Param If-Modified-Since header string false "the last modification time of the collection held by the client"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
+// @Failure 400 {string} the tag expression or filter is not valid
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
+// @Success 304 {string} the items have not been modified
 func GetItemsHandler(w http.ResponseWriter, r *http.Request) {
-	items, err := db.getItems()
+	filter, err := parseValueFilter(r.URL.Query()["filter"])
+	if err != nil {
+		log.Printf("%s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s\n", err))
+		return
+	}
+	fields, err := parseFields(r.URL.Query()["fields"])
+	if err != nil {
+		log.Printf("%s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s\n", err))
+		return
+	}
+	var items []src.I
+	if query := r.URL.Query().Get("tags"); len(query) > 0 {
+		expr, parseErr := parseTagExpr(query)
+		if parseErr != nil {
+			log.Printf("%s\n", parseErr)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s\n", parseErr))
+			return
+		}
+		// tagging does not change the collection stamp so requests selecting items by tags are not conditional
+		items, err = db.getItemsByTags(expr)
+	} else {
+		etag, modified, stampErr := db.getItemsStamp()
+		if stampErr != nil {
+			log.Printf("cannot get items: %s\n", stampErr)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get items: %s\n", stampErr))
+			return
+		}
+		if notModified(w, r, revealedETag(etag, revealsSecrets(r)), modified) {
+			return
+		}
+		if len(filter) > 0 {
+			items, err = db.getFilterCandidates("", filter)
+		} else {
+			items, err = db.getItems()
+		}
+	}
 	if err != nil {
 		log.Printf("cannot get types: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get types: %s\n", err))
 		return
 	}
+	// secrets are masked before filtering so that filters cannot be used to guess them
+	if err = maskItemList(r, items); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	if len(filter) > 0 {
+		items = filter.apply(items)
+	}
+	if len(fields) > 0 {
+		if err = fields.apply(items); err != nil {
+			log.Printf("cannot select configuration fields: %s\n", err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot select configuration fields: %s\n", err))
+			return
+		}
+	}
 	h.Write(w, r, items)
 }
 
@@ -242,6 +789,7 @@ func GetItemsHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/tag/{tags} [get]
 // @Param tags path string true "a pipe separated list of tags (e.g. tag1|tag2|tag3) where tag is the tag name, not the value"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
@@ -255,6 +803,11 @@ func GetTaggedItemsHandler(w http.ResponseWriter, r *http.Request) {
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get tagged items: %s\n", err))
 		return
 	}
+	if err = maskItemList(r, items); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
 	h.Write(w, r, items)
 }
 
@@ -264,18 +817,67 @@ func GetTaggedItemsHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/type/{type} [get]
 // @Param type path string true "the type of the configurations to retrieve"
+// @Param filter query []string false "predicates on the item values that must all match, e.g. $.region == 'eu', /replicas >= 3, $.tags contains 'pci' or $.owner exists; paths are JSONPath or JSON Pointer expressions" collectionFormat(multi)
+// @Param fields query []string false "the fields to keep in the item values as comma separated JSONPath or JSON Pointer paths (e.g. /name,$.db.host), other fields are removed" collectionFormat(multi)
+// @Param If-None-Match header string false "the entity tag of the collection held by the client"
+// @Param If-Modified-Since header string false "the last modification time of the collection held by the client"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
+// @Failure 400 {string} the filter is not valid
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
+// @Success 304 {string} the items have not been modified
 func GetItemsByTypeHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	t := vars["type"]
-	items, err := db.getItemsByType(t)
+	filter, err := parseValueFilter(r.URL.Query()["filter"])
+	if err != nil {
+		log.Printf("%s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s\n", err))
+		return
+	}
+	fields, err := parseFields(r.URL.Query()["fields"])
+	if err != nil {
+		log.Printf("%s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("%s\n", err))
+		return
+	}
+	etag, modified, err := db.getItemsByTypeStamp(t)
 	if err != nil {
 		log.Printf("cannot get items of type '%s': %s\n", t, err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get items of type '%s': %s\n", t, err))
 		return
 	}
+	if notModified(w, r, revealedETag(etag, revealsSecrets(r)), modified) {
+		return
+	}
+	var items []src.I
+	if len(filter) > 0 {
+		items, err = db.getFilterCandidates(t, filter)
+	} else {
+		items, err = db.getItemsByType(t)
+	}
+	if err != nil {
+		log.Printf("cannot get items of type '%s': %s\n", t, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get items of type '%s': %s\n", t, err))
+		return
+	}
+	// secrets are masked before filtering so that filters cannot be used to guess them
+	if err = maskItemList(r, items); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	if len(filter) > 0 {
+		items = filter.apply(items)
+	}
+	if len(fields) > 0 {
+		if err = fields.apply(items); err != nil {
+			log.Printf("cannot select configuration fields: %s\n", err)
+			h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot select configuration fields: %s\n", err))
+			return
+		}
+	}
 	h.Write(w, r, items)
 }
 
@@ -285,6 +887,7 @@ func GetItemsByTypeHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/pop/oldest/{type} [delete]
 // @Param type path string true "the type of the configuration to pop"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Failure 404 {string} there was no item to pop
@@ -302,6 +905,11 @@ func PopOldestByTypeHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err = maskItems(r, item); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
 	h.Write(w, r, item)
 }
 
@@ -311,6 +919,7 @@ func PopOldestByTypeHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/pop/newest/{type} [delete]
 // @Param type path string true "the type of the configuration to pop"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Failure 404 {string} there was no item to pop
@@ -328,6 +937,11 @@ func PopNewestByTypeHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err = maskItems(r, item); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
 	h.Write(w, r, item)
 }
 
@@ -337,15 +951,53 @@ func PopNewestByTypeHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/{key} [delete]
 // @Param key path string true "the key for the configuration item to delete"
+// @Param If-Match header string false "the entity tag of the item version to delete, the item is only deleted if its current version matches"
+// @Param cascade query string false "children to also delete the descendants of the item, following links from parents to children"
+// @Param restrict query boolean false "refuse to delete the item, or its descendants, if linked from other items"
 // @Produce json
 // @Failure 400 {string} the request is not correct
+// @Failure 409 {string} the item is linked from other items and restrict was specified
+// @Failure 412 {string} the item version does not match the If-Match header
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
 func DeleteItemHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	err := db.DeleteItem(key)
+	version, err := ifMatchVersion(r)
 	if err != nil {
+		log.Printf("cannot delete configuration: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot delete configuration: %s\n", err))
+		return
+	}
+	var opts deleteOptions
+	switch cascade := r.URL.Query().Get("cascade"); cascade {
+	case "":
+	case "children":
+		opts.cascade = true
+	default:
+		log.Printf("invalid cascade option '%s'\n", cascade)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid cascade option '%s', expected children\n", cascade))
+		return
+	}
+	if restrict := r.URL.Query().Get("restrict"); len(restrict) > 0 {
+		if opts.restrict, err = strconv.ParseBool(restrict); err != nil {
+			log.Printf("invalid restrict option '%s'\n", restrict)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid restrict option '%s', expected true or false\n", restrict))
+			return
+		}
+	}
+	err = db.DeleteItem(key, version, opts)
+	if err != nil {
+		if err == ErrVersionMismatch {
+			log.Printf("cannot delete configuration: %s\n", err)
+			h.Err(w, http.StatusPreconditionFailed, fmt.Sprintf("cannot delete configuration: %s\n", err))
+			return
+		}
+		if errors.Is(err, ErrItemLinked) {
+			log.Printf("cannot delete configuration: %s\n", err)
+			h.Err(w, http.StatusConflict, fmt.Sprintf("cannot delete configuration: %s\n", err))
+			return
+		}
 		log.Printf("cannot delete configuration: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot delete configuration: %s\n", err))
 		return
@@ -353,24 +1005,137 @@ func DeleteItemHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// GetItemHistoryHandler
+// @Summary Get the revision history of a configuration item
+// @Description Get the revisions kept for a configuration item, newest first
+// @Tags Items
+// @Router /item/{key}/history [get]
+// @Param key path string true "the key for the configuration item"
+// @Produce json
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {string} the request was successful
+func GetItemHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	revisions, err := db.getItemHistory(key)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get history of configuration '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get history of configuration '%s': %s\n", key, err))
+		return
+	}
+	h.Write(w, r, revisions)
+}
+
+// GetItemRevisionHandler
+// @Summary Get a revision of a configuration item
+// @Description Get the value of a configuration item at the specified revision
+// @Tags Items
+// @Router /item/{key}/revision/{revision} [get]
+// @Param key path string true "the key for the configuration item"
+// @Param revision path integer true "the revision number"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} revision not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {string} the request was successful
+func GetItemRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	revision, err := strconv.ParseInt(vars["revision"], 10, 64)
+	if err != nil {
+		log.Printf("invalid revision '%s': %s\n", vars["revision"], err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid revision '%s': %s\n", vars["revision"], err))
+		return
+	}
+	rev, err := db.getItemRevision(key, revision)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get revision %d of configuration '%s': %s\n", revision, key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get revision %d of configuration '%s': %s\n", revision, key, err))
+		return
+	}
+	value, err := newSecretMasker(r).mask(rev.Type, rev.Value)
+	if err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	rev.Value = value
+	h.Write(w, r, rev)
+}
+
+// RollbackItemHandler
+// @Summary Rollback a configuration item to a previous revision
+// @Description Set the value of a configuration item back to the value of the specified revision, the rollback is recorded as a new revision
+// @Tags Items
+// @Router /item/{key}/rollback/{revision} [post]
+// @Param key path string true "the key for the configuration item"
+// @Param revision path integer true "the revision number to rollback to"
+// @Produce json
+// @Failure 400 {object} ValidationFailure "the request is not correct, with all the errors found if the value does not satisfy the schema of the item type"
+// @Failure 404 {string} revision not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 204 {string} the request was successful
+func RollbackItemHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	revision, err := strconv.ParseInt(vars["revision"], 10, 64)
+	if err != nil {
+		log.Printf("invalid revision '%s': %s\n", vars["revision"], err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid revision '%s': %s\n", vars["revision"], err))
+		return
+	}
+	err, isValidationError := rollbackItem(db, key, revision)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == ErrItemTypeNotFound || isValidationError {
+			log.Printf("cannot rollback item '%s' to revision %d: %s\n", key, revision, err)
+			writeValidationErrors(w, r, fmt.Sprintf("cannot rollback item '%s' to revision %d", key, revision), err)
+			return
+		}
+		log.Printf("cannot rollback item '%s' to revision %d: %s\n", key, revision, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot rollback item '%s' to revision %d: %s\n", key, revision, err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // GetChildrenHandler
 // @Summary Get the children linked to a configuration
 // @Description Get the children linked to a configuration
 // @Tags Items
 // @Router /item/{key}/children [get]
 // @Param key path string true "the key for the item having the children"
+// @Param rel query string false "only the children linked by this kind of relationship"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
 func GetChildrenHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	children, err := db.getChildren(key)
+	children, err := db.getChildren(key, r.URL.Query().Get("rel"))
 	if err != nil {
 		log.Printf("cannot get types: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get types: %s\n", err))
 		return
 	}
+	if err = maskItemList(r, children); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
 	h.Write(w, r, children)
 }
 
@@ -380,21 +1145,166 @@ func GetChildrenHandler(w http.ResponseWriter, r *http.Request) {
 // @Tags Items
 // @Router /item/{key}/parents [get]
 // @Param key path string true "the key for the item having the children"
+// @Param rel query string false "only the parents linked by this kind of relationship"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 200 {string} the request was successful
 func GetParentsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	children, err := db.getParents(key)
+	children, err := db.getParents(key, r.URL.Query().Get("rel"))
 	if err != nil {
 		log.Printf("cannot get types: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get types: %s\n", err))
 		return
 	}
+	if err = maskItemList(r, children); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
 	h.Write(w, r, children)
 }
 
+// GetDescendantsHandler
+// @Summary Get the descendants of a configuration
+// @Description Get the configurations reachable from a configuration by following links from parents to children,
+// @Description along with the links traversed and any cycles found
+// @Tags Items
+// @Router /item/{key}/descendants [get]
+// @Param key path string true "the key for the item at the root of the graph"
+// @Param depth query integer false "the maximum number of links to follow, unlimited if not specified"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} Graph
+func GetDescendantsHandler(w http.ResponseWriter, r *http.Request) {
+	writeGraph(w, r, false)
+}
+
+// GetAncestorsHandler
+// @Summary Get the ancestors of a configuration
+// @Description Get the configurations from which a configuration is reachable by following links from children to
+// @Description parents, along with the links traversed and any cycles found
+// @Tags Items
+// @Router /item/{key}/ancestors [get]
+// @Param key path string true "the key for the item at the root of the graph"
+// @Param depth query integer false "the maximum number of links to follow, unlimited if not specified"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} Graph
+func GetAncestorsHandler(w http.ResponseWriter, r *http.Request) {
+	writeGraph(w, r, true)
+}
+
+// GetImpactHandler
+// @Summary Get the configurations depending on a configuration
+// @Description Get the configurations that transitively depend on a configuration, found by following links from
+// @Description children to parents, grouped by type and tag, along with any cycles amongst them.
+// @Description Use it to assess the impact of changing or deleting the configuration.
+// @Tags Items
+// @Router /item/{key}/impact [get]
+// @Param key path string true "the key for the configuration to analyse"
+// @Produce json
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} Impact
+func GetImpactHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	impact, err := impactOf(db, key)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot analyse the impact on configuration '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot analyse the impact on configuration '%s': %s\n", key, err))
+		return
+	}
+	h.Write(w, r, impact)
+}
+
+// GetEffectiveHandler
+// @Summary Get the effective value of a configuration
+// @Description Get the value of a configuration deep merged over the values of its ancestors, found by following
+// @Description links from children to parents, e.g. base -> environment -> region. Ancestors are merged from the
+// @Description farthest to the closest, those at the same distance in key order, so that closer layers win.
+// @Description The provenance lists the key of the configuration supplying each value, by JSON Pointer.
+// @Tags Items
+// @Router /item/{key}/effective [get]
+// @Param key path string true "the key for the configuration"
+// @Param rel query string false "only follow links of this kind, any kind but references if not specified"
+// @Param arrays query string false "how arrays are merged: replace (default), append or union"
+// @Param reveal query boolean false "reveal the properties marked as secret (x-secret) by the schema of the item type, masked by default, only if the service allows revealing secrets"
+// @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {object} EffectiveConfig
+func GetEffectiveHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	arrays := r.URL.Query().Get("arrays")
+	if len(arrays) == 0 {
+		arrays = "replace"
+	}
+	if !contains(arrayStrategies, arrays) {
+		log.Printf("invalid array strategy '%s'\n", arrays)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid array strategy '%s', expected one of %s\n", arrays, strings.Join(arrayStrategies, ", ")))
+		return
+	}
+	effective, err := effectiveConfig(db, key, r.URL.Query().Get("rel"), arrays, newSecretMasker(r))
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get effective configuration '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get effective configuration '%s': %s\n", key, err))
+		return
+	}
+	h.Write(w, r, effective)
+}
+
+// writeGraph writes the descendants or ancestors of the item in the request path
+func writeGraph(w http.ResponseWriter, r *http.Request, ancestors bool) {
+	key := mux.Vars(r)["key"]
+	depth := 0
+	if value := r.URL.Query().Get("depth"); len(value) > 0 {
+		var err error
+		if depth, err = strconv.Atoi(value); err != nil || depth < 1 {
+			log.Printf("invalid depth '%s'\n", value)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid depth '%s', expected a positive integer\n", value))
+			return
+		}
+	}
+	graph, err := db.getGraph(key, ancestors, depth, allLinks)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot get graph of configuration '%s': %s\n", key, err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot get graph of configuration '%s': %s\n", key, err))
+		return
+	}
+	items := make([]*src.I, len(graph.Items))
+	for i := range graph.Items {
+		items[i] = &graph.Items[i].I
+	}
+	if err = maskItems(r, items...); err != nil {
+		log.Printf("cannot mask secret configuration fields: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot mask secret configuration fields: %s\n", err))
+		return
+	}
+	h.Write(w, r, graph)
+}
+
 // SetTagHandler
 // @Summary Tag an item
 // @Description Tag the item identified by its key with a name
@@ -525,21 +1435,44 @@ func GetTagValueHandler(w http.ResponseWriter, r *http.Request) {
 
 // LinkHandler
 // @Summary Link two configurations
-// @Description Link two configurations
+// @Description Link two configurations with a kind of relationship, optionally describing the link with attributes.
+// @Description Configurations can be linked several times with different kinds of relationship, linking them again
+// @Description with the same kind of relationship replaces the attributes of the link.
 // @Tags Linking
 // @Router /link/{from-key}/to/{to-key} [put]
 // @Param from-key path string true "the key for the first configuration to link"
 // @Param to-key path string true "the key for the second configuration to link"
+// @Param rel query string false "the kind of relationship (e.g. depends-on), the link is untyped if not specified"
+// @Param attributes body object false "a json object describing the link"
 // @Accepts json
 // @Produce json
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} either configuration does not exist
 // @Failure 500 {string} there was an unexpected error processing the request
 // @Success 204 {string} the request was successful
 func LinkHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	from := vars["from-key"]
 	to := vars["to-key"]
-	err := db.Link(from, to)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("cannot read link attributes: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("cannot read link attributes: %s\n", err))
+		return
+	}
+	attributes, err := linkAttributes(body)
 	if err != nil {
+		log.Printf("invalid link attributes: %s\n", err)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid link attributes: %s\n", err))
+		return
+	}
+	err = db.Link(from, to, r.URL.Query().Get("rel"), attributes)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("cannot link configurations: %s\n", err)
+			h.Err(w, http.StatusNotFound, fmt.Sprintf("cannot link configurations: %s\n", err))
+			return
+		}
 		log.Printf("cannot link configurations: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot link configurations: %s\n", err))
 		return
@@ -554,6 +1487,7 @@ func LinkHandler(w http.ResponseWriter, r *http.Request) {
 // @Router /link/{from-key}/to/{to-key} [delete]
 // @Param from-key path string true "the key for the first configuration to unlink"
 // @Param to-key path string true "the key for the second configuration to unlink"
+// @Param rel query string false "the kind of relationship to remove, all the links between the configurations are removed if not specified"
 // @Accepts json
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
@@ -562,7 +1496,7 @@ func UnlinkHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	from := vars["from-key"]
 	to := vars["to-key"]
-	err := db.unLink(from, to)
+	err := db.unLink(from, to, r.URL.Query().Get("rel"))
 	if err != nil {
 		log.Printf("cannot unlink configurations: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot unlink configurations: %s\n", err))
@@ -576,12 +1510,13 @@ func UnlinkHandler(w http.ResponseWriter, r *http.Request) {
 // @Description Get all configuration links
 // @Tags Linking
 // @Router /link [get]
+// @Param rel query string false "only the links with this kind of relationship"
 // @Accepts json
 // @Produce json
 // @Failure 500 {string} there was an unexpected error processing the request
-// @Success 200 {string} the request was successful
+// @Success 200 {array} Link
 func GetLinksHandler(w http.ResponseWriter, r *http.Request) {
-	links, err := db.getLinks()
+	links, err := db.getLinks(r.URL.Query().Get("rel"))
 	if err != nil {
 		log.Printf("cannot retireve configuration links: %s\n", err)
 		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot retireve configuration links: %s\n", err))
@@ -590,6 +1525,65 @@ func GetLinksHandler(w http.ResponseWriter, r *http.Request) {
 	h.Write(w, r, links)
 }
 
+// ExportGraphHandler
+// @Summary Export configuration links as a graph
+// @Description Export the configurations and the links between them in a format that can be rendered as a diagram:
+// @Description dot (Graphviz), graphml or mermaid. Configurations are labelled with their key, type and selected tags.
+// @Description If a root is specified, only the configurations reachable from the root by following links from
+// @Description parents to children are exported, otherwise all linked configurations are exported.
+// @Tags Linking
+// @Router /link/graph [get]
+// @Param format query string true "the format of the graph: dot, graphml or mermaid"
+// @Param root query string false "the key of the configuration at the root of the graph"
+// @Param depth query integer false "the maximum number of links to follow from the root, unlimited if not specified"
+// @Param tags query string false "a comma separated list of the names of the tags to include in the labels"
+// @Produce plain
+// @Failure 400 {string} the request is not correct
+// @Failure 404 {string} the root configuration does not exist
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Success 200 {string} the graph in the requested format
+func ExportGraphHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	contentType, ok := graphFormats[format]
+	if !ok {
+		log.Printf("invalid graph format '%s'\n", format)
+		h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid graph format '%s', expected dot, graphml or mermaid\n", format))
+		return
+	}
+	root := r.URL.Query().Get("root")
+	depth := 0
+	if value := r.URL.Query().Get("depth"); len(value) > 0 {
+		var err error
+		if depth, err = strconv.Atoi(value); err != nil || depth < 1 || len(root) == 0 {
+			log.Printf("invalid depth '%s'\n", value)
+			h.Err(w, http.StatusBadRequest, fmt.Sprintf("invalid depth '%s', expected a positive integer along with a root\n", value))
+			return
+		}
+	}
+	var tagNames []string
+	if value := r.URL.Query().Get("tags"); len(value) > 0 {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				tagNames = append(tagNames, name)
+			}
+		}
+	}
+	nodes, links, err := exportGraph(db, root, depth, tagNames)
+	if err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot export configuration graph: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot export configuration graph: %s\n", err))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err = writeGraphFormat(w, format, nodes, links); err != nil {
+		log.Printf("cannot write configuration graph: %s\n", err)
+	}
+}
+
 // DeleteLinksHandler
 // @Summary Delete all configuration links
 // @Description Delete all configuration links
@@ -608,3 +1602,140 @@ func DeleteLinksHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// AdminSchemaHandler
+// @Summary Get the database schema version
+// @Description Get the version of the database schema and the migrations applied to it
+// @Tags Admin
+// @Router /admin/schema [get]
+// @Produce json
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not have a versioned schema
+// @Success 200 {object} SchemaInfo
+func AdminSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	inspector, ok := db.(schemaInspector)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not have a versioned schema\n")
+		return
+	}
+	info, err := inspector.schemaInfo()
+	if err != nil {
+		log.Printf("cannot retrieve schema information: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot retrieve schema information: %s\n", err))
+		return
+	}
+	h.Write(w, r, info)
+}
+
+// AdminRotateKeysHandler
+// @Summary Rewrap item data keys with the active master key
+// @Description Starts rewrapping the data keys encrypting item values with the active master key in the background,
+// @Description the service stays available whilst the rotation runs; use GET /admin/keys/rotation to follow its progress
+// @Tags Admin
+// @Router /admin/keys/rotation [post]
+// @Produce json
+// @Failure 409 {string} a key rotation is already running
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not encrypt values at rest
+// @Success 202 {object} KeyRotation
+func AdminRotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	rotator, ok := db.(keyRotator)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not encrypt values at rest\n")
+		return
+	}
+	rotation, err := rotator.rotateKeys()
+	if err != nil {
+		if err == ErrRotationRunning {
+			h.Err(w, http.StatusConflict, fmt.Sprintf("%s\n", err))
+			return
+		}
+		log.Printf("cannot start key rotation: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot start key rotation: %s\n", err))
+		return
+	}
+	// the content type must be set before the status is written
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	h.Write(w, r, rotation)
+}
+
+// AdminKeyRotationHandler
+// @Summary Get the progress of the last encryption key rotation
+// @Description Get the progress of the last rewrapping of item data keys with the active master key
+// @Tags Admin
+// @Router /admin/keys/rotation [get]
+// @Produce json
+// @Failure 404 {string} no key rotation has been started
+// @Failure 501 {string} the store does not encrypt values at rest
+// @Success 200 {object} KeyRotation
+func AdminKeyRotationHandler(w http.ResponseWriter, r *http.Request) {
+	rotator, ok := db.(keyRotator)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not encrypt values at rest\n")
+		return
+	}
+	rotation := rotator.keyRotation()
+	if rotation == nil {
+		h.Err(w, http.StatusNotFound, "no key rotation has been started\n")
+		return
+	}
+	h.Write(w, r, rotation)
+}
+
+// AdminShredItemHandler
+// @Summary Crypto-shred a configuration item
+// @Description Destroys the data key of a configuration item, so that its value and revisions cannot be recovered,
+// @Description and removes the item along with its tags and links
+// @Tags Admin
+// @Router /admin/shred/item/{key} [post]
+// @Param key path string true "the key of the configuration item to shred"
+// @Failure 404 {string} configuration not found
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not encrypt values at rest
+// @Success 204 {string} the item has been shredded
+func AdminShredItemHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := db.(shredder)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not encrypt values at rest\n")
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if err := s.shredItem(key); err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("cannot shred configuration: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot shred configuration: %s\n", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminShredTypeHandler
+// @Summary Crypto-shred all configuration items of a type
+// @Description Destroys the data keys of all configuration items of a type, so that their values and revisions
+// @Description cannot be recovered, and removes the items along with their tags and links
+// @Tags Admin
+// @Router /admin/shred/type/{type} [post]
+// @Param type path string true "the type of the configuration items to shred"
+// @Produce json
+// @Failure 500 {string} there was an unexpected error processing the request
+// @Failure 501 {string} the store does not encrypt values at rest
+// @Success 200 {object} map[string]int64 "the number of items shredded"
+func AdminShredTypeHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := db.(shredder)
+	if !ok {
+		h.Err(w, http.StatusNotImplemented, "the configured store does not encrypt values at rest\n")
+		return
+	}
+	iType := mux.Vars(r)["type"]
+	count, err := s.shredType(iType)
+	if err != nil {
+		log.Printf("cannot shred configurations: %s\n", err)
+		h.Err(w, http.StatusInternalServerError, fmt.Sprintf("cannot shred configurations: %s\n", err))
+		return
+	}
+	h.Write(w, r, map[string]int64{"shredded": count})
+}
@@ -0,0 +1,85 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import "sort"
+
+// Impact the items that transitively depend on an item, that is the items it can be reached from by following links
+// from parents to children
+type Impact struct {
+	// Key the key of the item analysed
+	Key string `json:"key"`
+	// Total the number of dependant items
+	Total int `json:"total"`
+	// Dependants the dependant items ordered by distance and key
+	Dependants []Dependant `json:"dependants"`
+	// ByType the keys of the dependant items by item type
+	ByType map[string][]string `json:"byType"`
+	// ByTag the keys of the dependant items by tag, as name or name=value
+	ByTag map[string][]string `json:"byTag"`
+	// Cycles the cycles found amongst the dependant items, a change can propagate back to the items in a cycle
+	Cycles [][]string `json:"cycles,omitempty"`
+}
+
+// Dependant an item depending on the item analysed
+type Dependant struct {
+	Key  string `json:"key"`
+	Type string `json:"type,omitempty"`
+	// Depth the number of links between the dependant item and the item analysed
+	Depth int      `json:"depth"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// impactOf get the items that transitively depend on an item
+func impactOf(s Store, key string) (*Impact, error) {
+	g, err := s.getGraph(key, true, 0, allLinks)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.getAllTags()
+	if err != nil {
+		return nil, err
+	}
+	itemTags := map[string][]string{}
+	for _, t := range tags {
+		name := t.Name
+		if len(t.Value) > 0 {
+			name += "=" + t.Value
+		}
+		itemTags[t.ItemKey] = append(itemTags[t.ItemKey], name)
+	}
+	impact := &Impact{
+		Key:        key,
+		Dependants: []Dependant{},
+		ByType:     map[string][]string{},
+		ByTag:      map[string][]string{},
+		Cycles:     g.Cycles,
+	}
+	// graph items are ordered by depth and key, the first one being the item analysed
+	for _, i := range g.Items {
+		if i.Key == key {
+			continue
+		}
+		d := Dependant{Key: i.Key, Type: i.Type, Depth: i.Depth, Tags: itemTags[i.Key]}
+		sort.Strings(d.Tags)
+		impact.Dependants = append(impact.Dependants, d)
+		impact.ByType[i.Type] = append(impact.ByType[i.Type], i.Key)
+		for _, t := range d.Tags {
+			impact.ByTag[t] = append(impact.ByTag[t], i.Key)
+		}
+	}
+	impact.Total = len(impact.Dependants)
+	for _, keys := range impact.ByType {
+		sort.Strings(keys)
+	}
+	for _, keys := range impact.ByTag {
+		sort.Strings(keys)
+	}
+	return impact, nil
+}
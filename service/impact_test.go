@@ -0,0 +1,54 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestImpact(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.setTypeFromString("app", []byte(`{}`), []byte(`{}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			// web and api depend on db, web and cache depend on each other
+			for _, i := range [][2]string{{"db", ""}, {"api", "app"}, {"web", "app"}, {"cache", ""}, {"lb", ""}} {
+				if err, _ := s.SetItem(i[0], i[1], `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			for _, l := range [][2]string{{"api", "db"}, {"web", "api"}, {"cache", "web"}, {"web", "cache"}, {"db", "lb"}} {
+				if err := s.Link(l[0], l[1], "depends-on", nil); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			if err := s.tagValue("web", "env", "prod"); err != nil {
+				t.Fatalf(err.Error())
+			}
+			impact, err := impactOf(s, "db")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if impact.Total != 3 || fmt.Sprint(impact.Dependants) != "[{api app 1 []} {web app 2 [env=prod]} {cache  3 []}]" {
+				t.Fatalf("unexpected dependants %v", impact.Dependants)
+			}
+			if fmt.Sprint(impact.ByType) != "map[:[cache] app:[api web]]" || fmt.Sprint(impact.ByTag) != "map[env=prod:[web]]" {
+				t.Fatalf("unexpected groups %v %v", impact.ByType, impact.ByTag)
+			}
+			if fmt.Sprint(impact.Cycles) != "[[web cache web]]" {
+				t.Fatalf("unexpected cycles %v", impact.Cycles)
+			}
+			if _, err = impactOf(s, "missing"); err != ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		})
+	}
+}
@@ -9,26 +9,69 @@
 package service
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 )
 
-var db *DataBase
+var db Store
 
 const homeFolder = ".source"
 
-// ensures the database exists
-func init() {
-	dbPath := getPath()
-	d, err := newDb(dbPath)
-	if err != nil {
-		log.Fatalf("cannot create database: %s", err)
-		panic(err)
+// Init creates the store used by the service, selected by the SOURCE_STORE environment variable
+// "sqlite" (the default) keeps data in a database under SOURCE_DATA_PATH, "postgres" keeps data in the PostgreSQL
+// database at SOURCE_DB_URL and "memory" keeps data in memory only
+// if SOURCE_STORE is not set but SOURCE_DB_URL is, "postgres" is used
+// secrets can be revealed on request only if SOURCE_ALLOW_REVEAL is true
+func Init() error {
+	if strings.ToLower(os.Getenv("SOURCE_ALLOW_REVEAL")) == "true" {
+		AllowReveal(true)
 	}
-	db = d
-	log.Printf("using '%s' database path\n", dbPath)
+	store := strings.ToLower(os.Getenv("SOURCE_STORE"))
+	dbUrl := os.Getenv("SOURCE_DB_URL")
+	if len(store) == 0 && len(dbUrl) > 0 {
+		store = "postgres"
+	}
+	// item values are encrypted at rest by the database stores
+	if store != "memory" {
+		if err := loadKey(); err != nil {
+			return err
+		}
+	}
+	switch store {
+	case "postgres":
+		if len(dbUrl) == 0 {
+			return fmt.Errorf("SOURCE_DB_URL must be set to use the postgres store")
+		}
+		d, err := newPgDb(dbUrl)
+		if err != nil {
+			return fmt.Errorf("cannot open database: %s", err)
+		}
+		db = d
+		log.Printf("using postgres database\n")
+	case "", "sqlite":
+		dbPath := getPath()
+		d, err := newDb(dbPath)
+		if err != nil {
+			return fmt.Errorf("cannot create database: %s", err)
+		}
+		db = d
+		log.Printf("using '%s' database path\n", dbPath)
+	case "memory":
+		db = NewMemoryStore()
+		log.Printf("using in-memory store, data will be lost when the service stops\n")
+	default:
+		return fmt.Errorf("unknown store '%s', valid values are 'sqlite', 'postgres' or 'memory'", store)
+	}
+	return nil
+}
+
+// UseStore sets the store used by the service, allowing to embed it with a specific store
+func UseStore(s Store) {
+	db = s
 }
 
 func getPath() string {
@@ -0,0 +1,93 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Link an association from a parent item to a child item
+type Link struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Rel the kind of relationship (e.g. depends-on, deployed-in), empty for untyped links
+	// items can be linked several times with different kinds of relationship
+	Rel string `json:"rel,omitempty"`
+	// Attributes a json object describing the link
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// linkKey identifies a link in the memory store
+type linkKey struct {
+	From, To, Rel string
+}
+
+// linkAttributes checks link attributes are a json object and returns them compacted, or nil if none were provided
+func linkAttributes(attributes []byte) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(attributes)) == 0 {
+		return nil, nil
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(attributes, &object); err != nil || object == nil {
+		return nil, fmt.Errorf("link attributes must be a json object")
+	}
+	var out bytes.Buffer
+	if err := json.Compact(&out, attributes); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// linkKinds selects the kinds of links followed by a traversal
+type linkKinds struct {
+	// only the kind of the links followed, links of any kind are followed if empty
+	only string
+	// except a kind of links not followed
+	except string
+}
+
+// allLinks follows links of any kind
+var allLinks = linkKinds{}
+
+// follows true if links of a kind are followed
+func (k linkKinds) follows(rel string) bool {
+	return (len(k.only) == 0 || rel == k.only) && (len(k.except) == 0 || rel != k.except)
+}
+
+// conditions the sql conditions on the kind of a link aliased as l, with their arguments
+func (k linkKinds) conditions() ([]string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+	if len(k.only) > 0 {
+		conditions = append(conditions, "l.rel = ?")
+		args = append(args, k.only)
+	}
+	if len(k.except) > 0 {
+		conditions = append(conditions, "l.rel <> ?")
+		args = append(args, k.except)
+	}
+	return conditions, args
+}
+
+// sortLinks orders links by parent, child and relationship
+func sortLinks(links []Link) func(i, j int) bool {
+	return func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		if links[i].To != links[j].To {
+			return links[i].To < links[j].To
+		}
+		return links[i].Rel < links[j].Rel
+	}
+}
@@ -0,0 +1,199 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTypedLinks(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"app", "db", "cluster"} {
+				if err, _ := s.SetItem(key, "", `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			// the same items linked by different kinds of relationship
+			if err := s.Link("app", "db", "depends-on", json.RawMessage(`{"port":5432}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := s.Link("app", "db", "owned-by", nil); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := s.Link("app", "cluster", "deployed-in", nil); err != nil {
+				t.Fatalf(err.Error())
+			}
+			// linking again replaces the attributes
+			if err := s.Link("app", "db", "depends-on", json.RawMessage(`{"port":5433}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			links, err := s.getLinks("")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if actual := fmt.Sprint(describeLinks(links)); actual != "[app>cluster:deployed-in: app>db:depends-on:{\"port\":5433} app>db:owned-by:]" {
+				t.Fatalf("unexpected links %s", actual)
+			}
+			links, err = s.getLinks("depends-on")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(links) != 1 || links[0].To != "db" {
+				t.Fatalf("expected the depends-on link only, got %v", describeLinks(links))
+			}
+			children, err := s.getChildren("app", "")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			// items linked several times are returned once
+			if len(children) != 2 {
+				t.Fatalf("expected 2 children, got %d", len(children))
+			}
+			children, err = s.getChildren("app", "deployed-in")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(children) != 1 || children[0].Key != "cluster" {
+				t.Fatalf("expected the cluster only, got %v", children)
+			}
+			parents, err := s.getParents("db", "owned-by")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(parents) != 1 || parents[0].Key != "app" {
+				t.Fatalf("expected the app only, got %v", parents)
+			}
+			// removes one kind of relationship, then all the remaining links between the items
+			if err = s.unLink("app", "db", "owned-by"); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if parents, _ = s.getParents("db", "owned-by"); len(parents) != 0 {
+				t.Fatalf("expected the owned-by link to be removed")
+			}
+			if parents, _ = s.getParents("db", ""); len(parents) != 1 {
+				t.Fatalf("expected the depends-on link to remain")
+			}
+			if err = s.unLink("app", "db", ""); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if links, _ = s.getLinks(""); len(links) != 1 {
+				t.Fatalf("expected the deployed-in link only, got %v", describeLinks(links))
+			}
+		})
+	}
+}
+
+func TestLinkAttributes(t *testing.T) {
+	for _, a := range []string{`[]`, `"a"`, `1`, `null`, `{`} {
+		if _, err := linkAttributes([]byte(a)); err == nil {
+			t.Fatalf("expected attributes %s to be rejected", a)
+		}
+	}
+	attributes, err := linkAttributes([]byte(`{ "a": 1 }`))
+	if err != nil || string(attributes) != `{"a":1}` {
+		t.Fatalf("unexpected attributes %s: %v", attributes, err)
+	}
+	if attributes, err = linkAttributes([]byte(" ")); err != nil || attributes != nil {
+		t.Fatalf("expected no attributes, got %s: %v", attributes, err)
+	}
+}
+
+func describeLinks(links []Link) []string {
+	var s []string
+	for _, l := range links {
+		s = append(s, fmt.Sprintf("%s>%s:%s:%s", l.From, l.To, l.Rel, string(l.Attributes)))
+	}
+	return s
+}
+
+func TestLinkIntegrity(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// app -> db -> disk, monitor -> db
+			for _, key := range []string{"app", "db", "disk", "monitor"} {
+				if err, _ := s.SetItem(key, "", `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			if err := s.Link("app", "missing", "", nil); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			if err := s.Link("missing", "app", "", nil); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			for _, l := range [][2]string{{"app", "db"}, {"db", "disk"}, {"monitor", "db"}} {
+				if err := s.Link(l[0], l[1], "", nil); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			// db is linked from app and monitor
+			if err := s.DeleteItem("db", 0, deleteOptions{restrict: true}); !errors.Is(err, ErrItemLinked) {
+				t.Fatalf("expected item linked, got %v", err)
+			}
+			// db, which app descends from, is linked from monitor
+			if err := s.DeleteItem("app", 0, deleteOptions{cascade: true, restrict: true}); !errors.Is(err, ErrItemLinked) {
+				t.Fatalf("expected item linked, got %v", err)
+			}
+			if _, err := s.getItem("db"); err != nil {
+				t.Fatalf("expected db to remain, got %v", err)
+			}
+			if err := s.DeleteItem("app", 0, deleteOptions{cascade: true}); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for _, key := range []string{"app", "db", "disk"} {
+				if _, err := s.getItem(key); err != ErrNotFound {
+					t.Fatalf("expected %s to be deleted, got %v", key, err)
+				}
+			}
+			if links, _ := s.getLinks(""); len(links) != 0 {
+				t.Fatalf("expected the links to be deleted, got %v", describeLinks(links))
+			}
+			if err := s.DeleteItem("monitor", 0, deleteOptions{restrict: true}); err != nil {
+				t.Fatalf(err.Error())
+			}
+		})
+	}
+}
+
+func TestPopRemovesLinksAndTags(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.setTypeFromString("job", []byte(`{}`), []byte(`{}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for _, i := range []struct{ key, iType string }{{"job1", "job"}, {"job2", "job"}, {"runner", ""}} {
+				if err, _ := s.SetItem(i.key, i.iType, `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			for _, l := range [][2]string{{"runner", "job1"}, {"job1", "job2"}} {
+				if err := s.Link(l[0], l[1], "", nil); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			if err := s.tagValue("job1", "env", "prod"); err != nil {
+				t.Fatalf(err.Error())
+			}
+			item, err := s.popOldestByType("job")
+			if err != nil || item == nil || item.Key != "job1" {
+				t.Fatalf("expected job1 to be popped, got %v %v", item, err)
+			}
+			if links, _ := s.getLinks(""); len(links) != 0 {
+				t.Fatalf("expected the links of the popped item to be removed, got %v", describeLinks(links))
+			}
+			if tags, _ := s.getAllTags(); len(tags) != 0 {
+				t.Fatalf("expected the tags of the popped item to be removed, got %v", tags)
+			}
+		})
+	}
+}
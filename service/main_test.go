@@ -0,0 +1,28 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"os"
+	"testing"
+)
+
+// testKey provides a fixed encryption key for the tests
+type testKey struct{}
+
+func (testKey) Key() ([]byte, error) {
+	return []byte("source-test-encryption-key"), nil
+}
+
+func TestMain(m *testing.M) {
+	if err := SetKeyProvider(testKey{}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
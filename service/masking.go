@@ -0,0 +1,252 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	h "southwinds.dev/http"
+	"southwinds.dev/source_client"
+	"strings"
+)
+
+// secretKeyword the json schema annotation marking a property as secret
+const secretKeyword = "x-secret"
+
+// secretMask replaces the value of secret properties in responses
+const secretMask = "********"
+
+// secretPaths finds the properties of a json schema annotated as secret, returned as paths of property names where
+// "*" stands for any array element or additional property
+func secretPaths(schema []byte) ([][]string, error) {
+	if len(schema) == 0 {
+		return nil, nil
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, fmt.Errorf("cannot read schema: %s", err)
+	}
+	var paths [][]string
+	collectSecrets(root, root, nil, map[string]bool{}, &paths)
+	return paths, nil
+}
+
+// collectSecrets walks a schema node collecting the paths of secret properties, following local references once per
+// path to cope with recursive definitions
+func collectSecrets(root, node map[string]interface{}, path []string, visited map[string]bool, paths *[][]string) {
+	if secret, ok := node[secretKeyword].(bool); ok && secret {
+		*paths = append(*paths, append([]string{}, path...))
+		return
+	}
+	if ref, ok := node["$ref"].(string); ok && !visited[ref] {
+		if target := resolveLocalRef(root, ref); target != nil {
+			visited[ref] = true
+			collectSecrets(root, target, path, visited, paths)
+			delete(visited, ref)
+		}
+	}
+	if props, ok := node["properties"].(map[string]interface{}); ok {
+		for name, prop := range props {
+			if p, ok := prop.(map[string]interface{}); ok {
+				collectSecrets(root, p, append(path, name), visited, paths)
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties"} {
+		if p, ok := node[keyword].(map[string]interface{}); ok {
+			collectSecrets(root, p, append(path, "*"), visited, paths)
+		}
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		if list, ok := node[keyword].([]interface{}); ok {
+			for _, sub := range list {
+				if p, ok := sub.(map[string]interface{}); ok {
+					collectSecrets(root, p, path, visited, paths)
+				}
+			}
+		}
+	}
+}
+
+// resolveLocalRef resolves a reference to a definition within the same schema (e.g. #/$defs/Name)
+func resolveLocalRef(root map[string]interface{}, ref string) map[string]interface{} {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+	var node interface{} = root
+	for _, token := range strings.Split(ref[2:], "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = m[token]
+	}
+	target, _ := node.(map[string]interface{})
+	return target
+}
+
+// maskPaths replaces the values at the specified paths of a json document with the secret mask
+func maskPaths(value []byte, paths [][]string) ([]byte, error) {
+	if len(paths) == 0 {
+		return value, nil
+	}
+	var doc interface{}
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		doc = maskPath(doc, path)
+	}
+	return json.Marshal(doc)
+}
+
+func maskPath(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		if node == nil {
+			return nil
+		}
+		return secretMask
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			for k, v := range n {
+				n[k] = maskPath(v, path[1:])
+			}
+		} else if v, ok := n[path[0]]; ok {
+			n[path[0]] = maskPath(v, path[1:])
+		}
+	case []interface{}:
+		if path[0] == "*" {
+			for i, v := range n {
+				n[i] = maskPath(v, path[1:])
+			}
+		}
+	}
+	return node
+}
+
+// secretMasker masks the secret properties of item values based on the schemas of their types
+type secretMasker struct {
+	store Store
+	// paths the secret paths by item type
+	paths map[string][][]string
+}
+
+// revealAllowed true if requests can reveal secrets, denied unless allowed by the operator
+var revealAllowed bool
+
+// AllowReveal allows or denies requests revealing the secret properties of items, using ?reveal=true
+// services set SOURCE_ALLOW_REVEAL to true to allow them, services embedding the package can call it after Init
+func AllowReveal(allow bool) {
+	revealAllowed = allow
+}
+
+// revealRequested true if a request asks for the secrets in the response to be revealed
+func revealRequested(r *http.Request) bool {
+	return r.URL.Query().Get("reveal") == "true"
+}
+
+// RevealMiddleware rejects the requests revealing secrets unless revealing secrets is allowed
+func RevealMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if revealRequested(r) && !revealAllowed {
+			log.Printf("secret fields reveal denied for %s %s requested from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			h.Err(w, http.StatusForbidden, "revealing secret fields is not allowed\n")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revealsSecrets true if the secrets in the response to a request are revealed, which must be both requested and allowed
+func revealsSecrets(r *http.Request) bool {
+	return revealRequested(r) && revealAllowed
+}
+
+// newSecretMasker a masker for the items in the response to a request, nil if the request reveals secrets
+func newSecretMasker(r *http.Request) *secretMasker {
+	if revealsSecrets(r) {
+		log.Printf("secret fields revealed for %s %s requested from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		return nil
+	}
+	return &secretMasker{store: db, paths: map[string][][]string{}}
+}
+
+// secrets gets the secret paths for an item type
+func (m *secretMasker) secrets(iType string) ([][]string, error) {
+	if len(iType) == 0 {
+		return nil, nil
+	}
+	if paths, ok := m.paths[iType]; ok {
+		return paths, nil
+	}
+	t, err := m.store.getTypeInfo(iType)
+	if err == ErrItemTypeNotFound {
+		// the type has been deleted after the item was written
+		m.paths[iType] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	paths, err := secretPaths(t.Schema)
+	if err != nil {
+		return nil, err
+	}
+	m.paths[iType] = paths
+	return paths, nil
+}
+
+// mask replaces the secret properties of a value of the specified type
+func (m *secretMasker) mask(iType string, value []byte) ([]byte, error) {
+	if m == nil || len(value) == 0 {
+		return value, nil
+	}
+	paths, err := m.secrets(iType)
+	if err != nil {
+		return nil, err
+	}
+	masked, err := maskPaths(value, paths)
+	if err != nil {
+		return nil, fmt.Errorf("cannot mask secrets of %s value: %s", iType, err)
+	}
+	return masked, nil
+}
+
+// maskItems masks the secret properties of items in place unless the request reveals secrets
+func maskItems(r *http.Request, items ...*src.I) error {
+	m := newSecretMasker(r)
+	if m == nil {
+		return nil
+	}
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		value, err := m.mask(item.Type, item.Value)
+		if err != nil {
+			return err
+		}
+		item.Value = value
+	}
+	return nil
+}
+
+// maskItemList masks the secret properties of a list of items in place unless the request reveals secrets
+func maskItemList(r *http.Request, items []src.I) error {
+	list := make([]*src.I, len(items))
+	for i := range items {
+		list[i] = &items[i]
+	}
+	return maskItems(r, list...)
+}
@@ -0,0 +1,135 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	schema := []byte(`{
+		"$ref": "#/$defs/Conn",
+		"$defs": {
+			"Conn": {
+				"type": "object",
+				"properties": {
+					"host": {"type": "string"},
+					"password": {"type": "string", "x-secret": true},
+					"users": {"type": "array", "items": {"$ref": "#/$defs/User"}}
+				}
+			},
+			"User": {
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"token": {"type": "string", "x-secret": true}
+				}
+			}
+		}
+	}`)
+	UseStore(NewMemoryStore())
+	if err := db.setTypeFromString("conn", schema, nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	value := `{"host":"db","password":"s3cret","users":[{"name":"a","token":"t1"},{"name":"b"}]}`
+	if err, _ := db.SetItem("c1", "conn", value, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	item, err := db.getItem("c1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = maskItems(httptest.NewRequest("GET", "/item/c1", nil), item); err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := `{"host":"db","password":"********","users":[{"name":"a","token":"********"},{"name":"b"}]}`
+	if string(item.Value) != expected {
+		t.Fatalf("expected masked value %s, got %s", expected, item.Value)
+	}
+	// secrets are not revealed unless allowed
+	item, _ = db.getItem("c1")
+	if err = maskItems(httptest.NewRequest("GET", "/item/c1?reveal=true", nil), item); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(item.Value) != expected {
+		t.Fatalf("expected masked value %s, got %s", expected, item.Value)
+	}
+	// secrets are only revealed on request
+	AllowReveal(true)
+	defer AllowReveal(false)
+	item, _ = db.getItem("c1")
+	if err = maskItems(httptest.NewRequest("GET", "/item/c1?reveal=true", nil), item); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(item.Value) != value {
+		t.Fatalf("expected revealed value %s, got %s", value, item.Value)
+	}
+}
+
+func TestRevealMiddleware(t *testing.T) {
+	handler := RevealMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	cases := []struct {
+		query   string
+		allowed bool
+		status  int
+	}{
+		{"", false, http.StatusOK},
+		{"?reveal=true", false, http.StatusForbidden},
+		{"?reveal=true", true, http.StatusOK},
+	}
+	defer AllowReveal(false)
+	for _, c := range cases {
+		AllowReveal(c.allowed)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/item/c1"+c.query, nil))
+		if w.Code != c.status {
+			t.Fatalf("query '%s' allowed %t: expected %d, got %d", c.query, c.allowed, c.status, w.Code)
+		}
+	}
+}
+
+func TestPopMasksSecrets(t *testing.T) {
+	UseStore(NewMemoryStore())
+	if err := db.setTypeFromString("conn", []byte(`{"properties":{"password":{"x-secret":true}}}`), nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, key := range []string{"c1", "c2"} {
+		if err, _ := db.SetItem(key, "conn", `{"password":"s3cret"}`, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	AllowReveal(true)
+	defer AllowReveal(false)
+	cases := []struct {
+		handler  http.HandlerFunc
+		query    string
+		password string
+	}{
+		{PopOldestByTypeHandler, "", secretMask},
+		{PopNewestByTypeHandler, "?reveal=true", "s3cret"},
+	}
+	for _, c := range cases {
+		r := mux.SetURLVars(httptest.NewRequest("DELETE", "/item/pop/conn"+c.query, nil), map[string]string{"type": "conn"})
+		w := httptest.NewRecorder()
+		c.handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+		}
+		expected := `"password":"` + c.password + `"`
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("expected %s in %s", expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,644 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"southwinds.dev/source_client"
+	"sync"
+	"time"
+)
+
+// memStore a store keeping everything in memory, for tests and ephemeral instances
+// values are not encrypted as they are never written to disk
+type memStore struct {
+	lock  sync.RWMutex
+	items map[string]*memItem
+	types map[string]*memType
+	// typeVersions the versions of the schema of item types, kept when types are deleted
+	typeVersions map[string][]TypeVersion
+	tags         map[string]map[string]string
+	links        map[linkKey]json.RawMessage
+	deleted      map[string]time.Time
+	// lastVersions the last versions of deleted items, from which the versions of items created again continue
+	lastVersions map[string]int64
+	// refs the keys of the items referenced by each item, whether the items referenced exist or not
+	refs map[string][]string
+}
+
+type memItem struct {
+	item        src.I
+	version     int64
+	typeVersion int64
+	revisions   []Revision
+}
+
+type memType struct {
+	info      src.TT
+	version   int64
+	retention *int
+}
+
+// NewMemoryStore create a new empty in-memory store
+func NewMemoryStore() Store {
+	return &memStore{
+		items:        map[string]*memItem{},
+		types:        map[string]*memType{},
+		typeVersions: map[string][]TypeVersion{},
+		tags:         map[string]map[string]string{},
+		links:        map[linkKey]json.RawMessage{},
+		deleted:      map[string]time.Time{},
+		lastVersions: map[string]int64{},
+		refs:         map[string][]string{},
+	}
+}
+
+func (m *memStore) setTypeFromString(key string, schema, proto []byte) error {
+	return m.setCheckedType(key, schema, proto, nil)
+}
+
+func (m *memStore) setCheckedType(key string, schema, proto []byte, check func(current []byte) error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, exists := m.types[key]
+	if check != nil {
+		var current []byte
+		if exists {
+			current = t.info.Schema
+		}
+		if err := check(current); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		t = new(memType)
+		m.types[key] = t
+	}
+	versions := m.typeVersions[key]
+	if exists && sameSchema(t.info.Schema, schema) {
+		t.info.Proto = copyBytes(proto)
+		versions[len(versions)-1].Proto = copyBytes(proto)
+		return nil
+	}
+	t.info = src.TT{Key: key, Schema: copyBytes(schema), Proto: copyBytes(proto)}
+	t.version = int64(len(versions)) + 1
+	m.typeVersions[key] = append(versions, TypeVersion{
+		Type:    key,
+		Version: t.version,
+		Schema:  copyBytes(schema),
+		Proto:   copyBytes(proto),
+		Created: time.Now().UTC(),
+	})
+	return nil
+}
+
+func (m *memStore) setTypeRetention(key string, retention int) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	t, exists := m.types[key]
+	if !exists {
+		return ErrItemTypeNotFound
+	}
+	t.retention = &retention
+	return nil
+}
+
+func (m *memStore) getTypeInfo(key string) (*src.TT, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	t, exists := m.types[key]
+	if !exists {
+		return nil, ErrItemTypeNotFound
+	}
+	info := t.info
+	return &info, nil
+}
+
+func (m *memStore) getTypeVersions(key string) ([]TypeVersion, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	versions := m.typeVersions[key]
+	if len(versions) == 0 {
+		return nil, ErrItemTypeNotFound
+	}
+	list := make([]TypeVersion, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		list = append(list, m.typeVersion(versions[i]))
+	}
+	return list, nil
+}
+
+func (m *memStore) getTypeVersion(key string, version int64) (*TypeVersion, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	versions := m.typeVersions[key]
+	if version < 1 || version > int64(len(versions)) {
+		return nil, ErrNotFound
+	}
+	v := m.typeVersion(versions[version-1])
+	return &v, nil
+}
+
+// typeVersion a copy of a type version along with the number of items validated against it
+func (m *memStore) typeVersion(v TypeVersion) TypeVersion {
+	v.Schema, v.Proto = copyBytes(v.Schema), copyBytes(v.Proto)
+	for _, i := range m.items {
+		if i.item.Type == v.Type && i.typeVersion == v.Version {
+			v.Items++
+		}
+	}
+	return v
+}
+
+func (m *memStore) getTypes() ([]src.TT, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var types []src.TT
+	for _, t := range m.types {
+		types = append(types, t.info)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Key < types[j].Key })
+	return types, nil
+}
+
+func (m *memStore) DeleteType(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.types, key)
+	return nil
+}
+
+func (m *memStore) SetItem(key, iType string, value interface{}, version int64) (error, bool) {
+	sv, typeInfo, err, isValidationError := prepareItem(m, key, iType, value)
+	if err != nil {
+		return err, isValidationError
+	}
+	typeKey := ""
+	if typeInfo != nil {
+		typeKey = typeInfo.Key
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var typeVersion int64
+	if typeInfo != nil {
+		t, found := m.types[typeKey]
+		if !found {
+			return ErrItemTypeNotFound, false
+		}
+		// the schema could have changed since the value was validated
+		if !sameSchema(t.info.Schema, typeInfo.Schema) {
+			if err, isValidationError := validate(sv, &t.info); err != nil {
+				return err, isValidationError
+			}
+		}
+		typeVersion = t.version
+	}
+	i, exists := m.items[key]
+	if (version > 0 && (!exists || i.version != version)) || (version == anyVersion && !exists) {
+		return ErrVersionMismatch, false
+	}
+	if !exists {
+		i = &memItem{version: m.lastVersions[key]}
+		m.items[key] = i
+	}
+	i.version++
+	i.typeVersion = typeVersion
+	i.item = src.I{
+		Key:     key,
+		Type:    typeKey,
+		Value:   []byte(sv),
+		Updated: time.Now().UTC(),
+	}
+	i.revisions = append(i.revisions, Revision{
+		Key:      key,
+		Revision: i.version,
+		Type:     typeKey,
+		Value:    []byte(sv),
+		Updated:  i.item.Updated,
+	})
+	retention := defaultRetention
+	if t, found := m.types[typeKey]; found && t.retention != nil {
+		retention = *t.retention
+	}
+	if retention > 0 && len(i.revisions) > retention {
+		i.revisions = i.revisions[len(i.revisions)-retention:]
+	}
+	// replaces the links to the items referenced
+	for l := range m.links {
+		if l.From == key && l.Rel == refRel {
+			delete(m.links, l)
+		}
+	}
+	m.refs[key] = referencedItems(key, i.item.Value)
+	for _, ref := range m.refs[key] {
+		if _, found := m.items[ref]; found {
+			m.links[linkKey{From: key, To: ref, Rel: refRel}] = nil
+		}
+	}
+	// links the items that referenced the item before it was created
+	for from, refs := range m.refs {
+		for _, ref := range refs {
+			if ref == key {
+				m.links[linkKey{From: from, To: key, Rel: refRel}] = nil
+			}
+		}
+	}
+	return nil, false
+}
+
+func (m *memStore) getItem(key string) (*src.I, error) {
+	item, _, err := m.getVersionedItem(key)
+	return item, err
+}
+
+func (m *memStore) getVersionedItem(key string) (*src.I, int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	i, exists := m.items[key]
+	if !exists {
+		return nil, 0, ErrNotFound
+	}
+	item := copyItem(i.item)
+	return &item, i.version, nil
+}
+
+func (m *memStore) getItemStamp(key string) (int64, time.Time, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	i, exists := m.items[key]
+	if !exists {
+		return 0, time.Time{}, ErrNotFound
+	}
+	return i.version, i.item.Updated, nil
+}
+
+func (m *memStore) getItems() ([]src.I, error) {
+	return m.selectItems(func(i *memItem) bool { return true }), nil
+}
+
+func (m *memStore) getItemTypes() (map[string]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	types := make(map[string]string, len(m.items))
+	for key, i := range m.items {
+		types[key] = i.item.Type
+	}
+	return types, nil
+}
+
+func (m *memStore) getItemsStamp() (string, time.Time, error) {
+	var deleted time.Time
+	m.lock.RLock()
+	for _, t := range m.deleted {
+		if t.After(deleted) {
+			deleted = t
+		}
+	}
+	m.lock.RUnlock()
+	return m.stamp(func(i *memItem) bool { return true }, deleted)
+}
+
+func (m *memStore) getItemsByType(t string) ([]src.I, error) {
+	return m.selectItems(func(i *memItem) bool { return i.item.Type == t }), nil
+}
+
+func (m *memStore) getItemTypeVersions(t string) (map[string]int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	versions := map[string]int64{}
+	for key, i := range m.items {
+		if i.item.Type == t && i.typeVersion > 0 {
+			versions[key] = i.typeVersion
+		}
+	}
+	return versions, nil
+}
+
+func (m *memStore) getItemsByTypeStamp(t string) (string, time.Time, error) {
+	m.lock.RLock()
+	deleted := m.deleted[t]
+	m.lock.RUnlock()
+	return m.stamp(func(i *memItem) bool { return i.item.Type == t }, deleted)
+}
+
+func (m *memStore) DeleteItem(key string, version int64, opts deleteOptions) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	i, exists := m.items[key]
+	if (version > 0 && (!exists || i.version != version)) || (version == anyVersion && !exists) {
+		return ErrVersionMismatch
+	}
+	if !exists {
+		return nil
+	}
+	deleted := map[string]bool{key: true}
+	if opts.cascade {
+		queue := []string{key}
+		for len(queue) > 0 {
+			k := queue[0]
+			queue = queue[1:]
+			for l := range m.links {
+				// the items referenced are not children, they can be shared with other items
+				if _, found := m.items[l.To]; l.From == k && l.Rel != refRel && found && !deleted[l.To] {
+					deleted[l.To] = true
+					queue = append(queue, l.To)
+				}
+			}
+		}
+	}
+	if opts.restrict {
+		var linked []Link
+		seen := map[[2]string]bool{}
+		for l := range m.links {
+			if deleted[l.To] && !deleted[l.From] && !seen[[2]string{l.From, l.To}] {
+				seen[[2]string{l.From, l.To}] = true
+				linked = append(linked, Link{From: l.From, To: l.To})
+			}
+		}
+		if err := linkedError(linked); err != nil {
+			return err
+		}
+	}
+	for k := range deleted {
+		m.deleted[m.items[k].item.Type] = time.Now().UTC()
+		m.removeItem(k)
+	}
+	return nil
+}
+
+func (m *memStore) popOldestByType(itemType string) (*src.I, error) {
+	return m.pop(itemType, func(a, b time.Time) bool { return a.Before(b) })
+}
+
+func (m *memStore) popNewestByType(itemType string) (*src.I, error) {
+	return m.pop(itemType, func(a, b time.Time) bool { return a.After(b) })
+}
+
+func (m *memStore) getItemHistory(key string) ([]Revision, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	i, exists := m.items[key]
+	if !exists || len(i.revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	var revisions []Revision
+	for ix := len(i.revisions) - 1; ix >= 0; ix-- {
+		rev := i.revisions[ix]
+		rev.Value = nil
+		revisions = append(revisions, rev)
+	}
+	return revisions, nil
+}
+
+func (m *memStore) getItemRevision(key string, revision int64) (*Revision, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	i, exists := m.items[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	for _, rev := range i.revisions {
+		if rev.Revision == revision {
+			rev.Value = copyBytes(rev.Value)
+			return &rev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) tag(key, name string) error {
+	return m.tagValue(key, name, "")
+}
+
+func (m *memStore) tagValue(key, name, value string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tags, exists := m.tags[key]
+	if !exists {
+		tags = map[string]string{}
+		m.tags[key] = tags
+	}
+	tags[name] = value
+	return nil
+}
+
+func (m *memStore) untag(key string, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.tags[key], name)
+	return nil
+}
+
+func (m *memStore) getTags(key string) ([]src.T, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var tags []src.T
+	for name, value := range m.tags[key] {
+		tags = append(tags, src.T{Name: name, Value: value})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+func (m *memStore) getAllTags() ([]src.T, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var tags []src.T
+	for key, itemTags := range m.tags {
+		for name, value := range itemTags {
+			tags = append(tags, src.T{ItemKey: key, Name: name, Value: value})
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].ItemKey == tags[j].ItemKey {
+			return tags[i].Name < tags[j].Name
+		}
+		return tags[i].ItemKey < tags[j].ItemKey
+	})
+	return tags, nil
+}
+
+func (m *memStore) getTaggedItems(tags ...string) ([]src.I, error) {
+	m.lock.RLock()
+	tagged := map[string]bool{}
+	for key, itemTags := range m.tags {
+		for _, name := range tags {
+			if _, found := itemTags[name]; found {
+				tagged[key] = true
+			}
+		}
+	}
+	m.lock.RUnlock()
+	return m.selectItems(func(i *memItem) bool { return tagged[i.item.Key] }), nil
+}
+
+func (m *memStore) getFilterCandidates(t string, f valueFilter) ([]src.I, error) {
+	// items are not indexed as they are held in plain text
+	if len(t) == 0 {
+		return m.getItems()
+	}
+	return m.getItemsByType(t)
+}
+
+func (m *memStore) getItemsByTags(expr tagExpr) ([]src.I, error) {
+	// the filter runs with the store locked
+	return m.selectItems(func(i *memItem) bool { return expr.match(m.tags[i.item.Key]) }), nil
+}
+
+func (m *memStore) Link(from, to, rel string, attributes json.RawMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, key := range []string{from, to} {
+		if _, exists := m.items[key]; !exists {
+			return fmt.Errorf("cannot link '%s': %w", key, ErrNotFound)
+		}
+	}
+	m.links[linkKey{From: from, To: to, Rel: rel}] = copyBytes(attributes)
+	return nil
+}
+
+func (m *memStore) unLink(from, to, rel string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for l := range m.links {
+		if l.From == from && l.To == to && (len(rel) == 0 || l.Rel == rel) {
+			delete(m.links, l)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) getLinks(rel string) ([]Link, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var links []Link
+	for l, attributes := range m.links {
+		if len(rel) == 0 || l.Rel == rel {
+			links = append(links, Link{From: l.From, To: l.To, Rel: l.Rel, Attributes: copyBytes(attributes)})
+		}
+	}
+	sort.Slice(links, sortLinks(links))
+	return links, nil
+}
+
+func (m *memStore) deleteLinks() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.links = map[linkKey]json.RawMessage{}
+	return nil
+}
+
+func (m *memStore) getChildren(parentKey, rel string) ([]src.I, error) {
+	m.lock.RLock()
+	children := map[string]bool{}
+	for l := range m.links {
+		if l.From == parentKey && (len(rel) == 0 || l.Rel == rel) {
+			children[l.To] = true
+		}
+	}
+	m.lock.RUnlock()
+	return m.selectItems(func(i *memItem) bool { return children[i.item.Key] }), nil
+}
+
+func (m *memStore) getParents(childKey, rel string) ([]src.I, error) {
+	m.lock.RLock()
+	parents := map[string]bool{}
+	for l := range m.links {
+		if l.To == childKey && (len(rel) == 0 || l.Rel == rel) {
+			parents[l.From] = true
+		}
+	}
+	m.lock.RUnlock()
+	return m.selectItems(func(i *memItem) bool { return parents[i.item.Key] }), nil
+}
+
+// selectItems copies of the items matching a filter, ordered by key
+func (m *memStore) selectItems(filter func(i *memItem) bool) []src.I {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var items []src.I
+	for _, i := range m.items {
+		if filter(i) {
+			items = append(items, copyItem(i.item))
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	return items
+}
+
+// stamp hashes the keys and versions of the items matching a filter in the same way as the database store
+func (m *memStore) stamp(filter func(i *memItem) bool, deleted time.Time) (string, time.Time, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var selected []*memItem
+	for _, i := range m.items {
+		if filter(i) {
+			selected = append(selected, i)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].item.Key < selected[j].item.Key })
+	hash := sha256.New()
+	modified := deleted
+	for _, i := range selected {
+		_, _ = fmt.Fprintf(hash, "%s:%d\n", i.item.Key, i.version)
+		if i.item.Updated.After(modified) {
+			modified = i.item.Updated
+		}
+	}
+	return stampETag(hash.Sum(nil)), modified, nil
+}
+
+// pop removes the item of a type that comes first according to the specified ordering of update times
+func (m *memStore) pop(itemType string, first func(a, b time.Time) bool) (*src.I, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var found *memItem
+	for _, i := range m.items {
+		if i.item.Type == itemType && (found == nil || first(i.item.Updated, found.item.Updated)) {
+			found = i
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+	item := copyItem(found.item)
+	m.deleted[itemType] = time.Now().UTC()
+	m.removeItem(item.Key)
+	return &item, nil
+}
+
+// removeItem removes an item with its tags and links, the caller must hold the write lock
+func (m *memStore) removeItem(key string) {
+	if i, exists := m.items[key]; exists {
+		m.lastVersions[key] = i.version
+	}
+	delete(m.items, key)
+	delete(m.tags, key)
+	delete(m.refs, key)
+	for l := range m.links {
+		if l.From == key || l.To == key {
+			delete(m.links, l)
+		}
+	}
+}
+
+func copyItem(item src.I) src.I {
+	item.Value = copyBytes(item.Value)
+	return item
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
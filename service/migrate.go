@@ -0,0 +1,379 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration a numbered change to the database schema
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sqlTx) error
+}
+
+// migrations the ordered list of schema migrations
+// new migrations must be appended at the end with the next version number, released migrations must never be changed
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial schema",
+		// uses IF NOT EXISTS so that databases created before versioning was introduced are brought under control
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// stores configuration items
+				`CREATE TABLE IF NOT EXISTS item (
+        "key"        VARCHAR(100) NOT NULL PRIMARY KEY,
+        "type"       VARCHAR(100) NOT NULL,
+        "value"      BLOB NOT NULL,
+		"updated"    INTEGER NOT NULL
+	    );`,
+				// stores tags for configuration items
+				`CREATE TABLE IF NOT EXISTS tag (
+        "item_key"        VARCHAR(100) NOT NULL,
+        "name"            VARCHAR(100) NOT NULL,
+        "value"           VARCHAR(100),
+        PRIMARY KEY ("item_key", "name")
+	    );`,
+				// stores associations between configuration items
+				`CREATE TABLE IF NOT EXISTS link (
+        "from_key"        VARCHAR(100) NOT NULL,
+        "to_key"          VARCHAR(100) NOT NULL,
+        PRIMARY KEY ("from_key", "to_key")
+	    );`,
+				// stores json schemas for validation
+				`CREATE TABLE IF NOT EXISTS type (
+        "key"        VARCHAR(100) NOT NULL PRIMARY KEY,
+        "schema"     BLOB NOT NULL,
+        "proto"      BLOB NOT NULL
+	    );`)
+		},
+	},
+	{
+		version:     2,
+		description: "item revision history",
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// stores the values written to configuration items
+				`CREATE TABLE item_revision (
+        "item_key"   VARCHAR(100) NOT NULL,
+        "revision"   INTEGER NOT NULL,
+        "type"       VARCHAR(100) NOT NULL,
+        "value"      BLOB NOT NULL,
+        "updated"    INTEGER NOT NULL,
+        PRIMARY KEY ("item_key", "revision")
+	    );`,
+				// the number of revisions to keep for items of a type
+				`ALTER TABLE type ADD COLUMN "retention" INTEGER;`,
+				// existing values become the first revision of their items
+				`INSERT INTO item_revision(item_key, revision, type, value, updated) SELECT key, 1, type, value, updated FROM item;`)
+		},
+	},
+	{
+		version:     3,
+		description: "item versions for optimistic concurrency",
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// incremented on every write of an item
+				`ALTER TABLE item ADD COLUMN "version" INTEGER NOT NULL DEFAULT 1;`,
+				// the version of an item continues from its latest revision
+				`UPDATE item SET version = (SELECT COALESCE(MAX(r.revision), 1) FROM item_revision r WHERE r.item_key = item.key);`)
+		},
+	},
+	{
+		version:     4,
+		description: "item deletion times",
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// stores when an item of a type was last deleted
+				`CREATE TABLE item_deleted (
+        "type"       VARCHAR(100) NOT NULL PRIMARY KEY,
+        "deleted"    INTEGER NOT NULL
+	    );`)
+		},
+	},
+	{
+		version:     5,
+		description: "re-encrypt item values with the configured key",
+		// values were encrypted with a key compiled into the service
+		up: reEncryptLegacy,
+	},
+	{
+		version:     6,
+		description: "record key identifiers in encrypted values",
+		up:          prefixKeyIds,
+	},
+	{
+		version:     7,
+		description: "bind encrypted values to their item",
+		up:          bindValues,
+	},
+	{
+		version:     8,
+		description: "encrypt item values with per item data keys",
+		up:          envelopeValues,
+	},
+	{
+		version:     9,
+		description: "indexed item fields",
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				`ALTER TABLE type ADD COLUMN "indexed" TEXT;`,
+				// the plain text values of the indexed fields of items
+				`CREATE TABLE item_field
+	    (
+        "item_key" TEXT NOT NULL,
+        "pointer"  TEXT NOT NULL,
+        "value"    TEXT NOT NULL,
+        PRIMARY KEY ("item_key", "pointer")
+	    );`,
+				`CREATE INDEX item_field_value ON item_field (pointer, value);`)
+		},
+	},
+	{
+		version:     10,
+		description: "typed links with attributes",
+		// the primary key changes so the table is rebuilt, existing links become untyped links
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				`CREATE TABLE link_rel (
+        "from_key"        VARCHAR(100) NOT NULL,
+        "to_key"          VARCHAR(100) NOT NULL,
+        "rel"             VARCHAR(100) NOT NULL DEFAULT '',
+        "attributes"      TEXT,
+        PRIMARY KEY ("from_key", "to_key", "rel")
+	    );`,
+				`INSERT INTO link_rel(from_key, to_key) SELECT from_key, to_key FROM link;`,
+				`DROP TABLE link;`,
+				`ALTER TABLE link_rel RENAME TO link;`,
+				// finds the parents of an item
+				`CREATE INDEX link_to_key ON link (to_key);`)
+		},
+	},
+	{
+		version:     11,
+		description: "type schema versions",
+		// the current schemas become the first versions, the versions existing items were validated against are unknown
+		up: func(tx *sqlTx) error {
+			if err := execTx(tx,
+				`ALTER TABLE type ADD COLUMN "version" INTEGER NOT NULL DEFAULT 1;`,
+				// stores every version of the schema of item types
+				`CREATE TABLE type_version (
+        "type_key"   VARCHAR(100) NOT NULL,
+        "version"    INTEGER NOT NULL,
+        "schema"     BLOB NOT NULL,
+        "proto"      BLOB NOT NULL,
+        "created"    INTEGER NOT NULL,
+        PRIMARY KEY ("type_key", "version")
+	    );`,
+				// the version of the schema of its type an item was last validated against
+				`ALTER TABLE item ADD COLUMN "type_version" INTEGER;`); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO type_version(type_key, version, schema, proto, created) SELECT key, 1, schema, proto, ? FROM type;`, time.Now().UTC().UnixNano())
+			return err
+		},
+	},
+	{
+		version:     12,
+		description: "versions of deleted items",
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// stores the last version of deleted items, so that the versions of items created again keep rising
+				`CREATE TABLE item_last_version (
+        "key"        VARCHAR(100) NOT NULL PRIMARY KEY,
+        "version"    INTEGER NOT NULL
+	    );`)
+		},
+	},
+	{
+		version:     13,
+		description: "remove tags and links of popped items",
+		// popping items used to leave their tags and links behind
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				`DELETE FROM tag WHERE item_key NOT IN (SELECT key FROM item);`,
+				`DELETE FROM link WHERE from_key NOT IN (SELECT key FROM item) OR to_key NOT IN (SELECT key FROM item);`)
+		},
+	},
+	{
+		version:     14,
+		description: "item references",
+		// references to items that do not exist were not recorded, they are recorded when the referencing item is next set
+		up: func(tx *sqlTx) error {
+			return execTx(tx,
+				// stores the keys of the items referenced by item values, whether the items referenced exist or not
+				`CREATE TABLE item_reference (
+        "from_key"   VARCHAR(100) NOT NULL,
+        "to_key"     VARCHAR(100) NOT NULL,
+        PRIMARY KEY ("from_key", "to_key")
+	    );`,
+				// finds the items referencing an item when it is created
+				`CREATE INDEX item_reference_to_key ON item_reference (to_key);`,
+				`INSERT INTO item_reference(from_key, to_key) SELECT from_key, to_key FROM link WHERE rel = 'references';`)
+		},
+	},
+}
+
+// SchemaInfo the version information of the database schema
+type SchemaInfo struct {
+	// Version the version of the schema currently applied to the database
+	Version int `json:"version"`
+	// Latest the latest schema version known to this build of the service
+	Latest int `json:"latest"`
+	// Applied the migrations applied to the database
+	Applied []AppliedMigration `json:"applied"`
+}
+
+// AppliedMigration a migration that has been applied to the database
+type AppliedMigration struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	Applied     time.Time `json:"applied"`
+}
+
+// latestVersion the version of the last known migration
+func latestVersion() int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings the database schema up to the latest version applying any pending migrations in order
+func migrate(db *sqlDB) error {
+	if err := withMigrationLock(db, func(tx *sqlTx) error {
+		return execTx(tx, `CREATE TABLE IF NOT EXISTS schema_version (
+        "version"        INTEGER NOT NULL PRIMARY KEY,
+        "description"    VARCHAR(200) NOT NULL,
+        "applied"        INTEGER NOT NULL
+	    );`)
+	}); err != nil {
+		return fmt.Errorf("cannot create schema version table: %s", err)
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	latest := latestVersion()
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest version %d supported by this build, refusing to start", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err = applyMigration(db, m); err != nil {
+			return fmt.Errorf("cannot apply migration %d (%s): %w", m.version, m.description, err)
+		}
+		log.Printf("applied database migration %d: %s\n", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration applies a single migration and records it in the schema_version table within the same transaction
+func applyMigration(db *sqlDB, m migration) error {
+	return withMigrationLock(db, func(tx *sqlTx) error {
+		// another instance of the service might have applied the migration in the meantime
+		var current sql.NullInt64
+		if err := tx.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(&current); err != nil {
+			return err
+		}
+		if int(current.Int64) >= m.version {
+			return nil
+		}
+		if err := m.up(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO schema_version(version, description, applied) VALUES(?, ?, ?);`, m.version, m.description, time.Now().UTC().UnixNano())
+		return err
+	})
+}
+
+// withMigrationLock runs a function in a transaction holding the migration lock of the dialect, if any
+func withMigrationLock(db *sqlDB, f func(tx *sqlTx) error) error {
+	tx, err := db.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	if len(db.dialect.migrationLock) > 0 {
+		if _, err = tx.Exec(db.dialect.migrationLock); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	if err = f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// schemaVersion the current version of the database schema, zero if no migrations have been applied
+func schemaVersion(db *sqlDB) (int, error) {
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("cannot read schema version: %s", err)
+	}
+	return int(version.Int64), nil
+}
+
+// schemaInfo get the version information of the database schema
+func (d *DataBase) schemaInfo() (*SchemaInfo, error) {
+	current, err := schemaVersion(d.db)
+	if err != nil {
+		return nil, err
+	}
+	row, err := d.db.Query(`SELECT version, description, applied FROM schema_version ORDER BY version;`)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	info := &SchemaInfo{
+		Version: current,
+		Latest:  latestVersion(),
+		Applied: []AppliedMigration{},
+	}
+	var (
+		version     int
+		description string
+		applied     int64
+	)
+	for row.Next() {
+		if err = row.Scan(&version, &description, &applied); err != nil {
+			return nil, err
+		}
+		info.Applied = append(info.Applied, AppliedMigration{
+			Version:     version,
+			Description: description,
+			Applied:     time.Unix(0, applied).UTC(),
+		})
+	}
+	return info, nil
+}
+
+// execTx executes data definition and migration statements in a transaction, translated for its dialect
+func execTx(tx *sqlTx, stmts ...string) error {
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(tx.dialect.ddl(stmt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	path := t.TempDir()
+	// create db and apply all migrations
+	d, err := newDb(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	info, err := d.schemaInfo()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if info.Version != latestVersion() || len(info.Applied) != len(migrations) {
+		t.Fatalf("expected schema version %d with %d migrations, got version %d with %d migrations", latestVersion(), len(migrations), info.Version, len(info.Applied))
+	}
+	// re-opening an up-to-date database must not apply anything
+	if err = migrate(d.db); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// simulates a database written by a newer build
+	if _, err = d.db.Exec(`INSERT INTO schema_version(version, description, applied) VALUES(?, 'future', 0);`, latestVersion()+1); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_ = d.db.Close()
+	if _, err = newDb(path); err == nil {
+		t.Fatalf("expected refusal to open a database with a newer schema version")
+	}
+}
+
+func TestReEncryptLegacy(t *testing.T) {
+	path := t.TempDir()
+	// creates a database as written by a release using the legacy key
+	latest := migrations
+	migrations = latest[:4]
+	db, err := getDb(path)
+	migrations = latest
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	legacy := sha256.Sum256([]byte(legacyKey))
+	value, err := encryptWith(legacy[:], []byte(`{"a":1}`), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = db.Exec(`INSERT INTO item(key, type, value, updated, version) VALUES('legacy', '', ?, 0, 1);`, value); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_ = db.Close()
+	// re-opening applies the re-encryption
+	d, err := newDb(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	item, err := d.getItem("legacy")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(item.Value) != `{"a":1}` {
+		t.Fatalf("unexpected value %s", item.Value)
+	}
+}
+
+func TestReEncryptWithoutKey(t *testing.T) {
+	path := t.TempDir()
+	latest := migrations
+	migrations = latest[:4]
+	db, err := getDb(path)
+	migrations = latest
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	legacy := sha256.Sum256([]byte(legacyKey))
+	value, err := encryptWith(legacy[:], []byte(`{"a":1}`), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = db.Exec(`INSERT INTO item(key, type, value, updated, version) VALUES('legacy', '', ?, 0, 1);`, value); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_ = db.Close()
+	// an embedder opening the database before setting a key provider
+	active := keys
+	keys = nil
+	defer func() { keys = active }()
+	if _, err = newDb(path); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("expected ErrNoKey, got %v", err)
+	}
+	// a database without values to convert does not need a key to be migrated
+	if _, err = newDb(t.TempDir()); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
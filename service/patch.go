@@ -0,0 +1,386 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// mergePatchType the media type of JSON Merge Patch documents (RFC 7386)
+	mergePatchType = "application/merge-patch+json"
+	// jsonPatchType the media type of JSON Patch documents (RFC 6902)
+	jsonPatchType = "application/json-patch+json"
+	// patchRetries the number of times a patch is applied again when the item is updated concurrently
+	patchRetries = 5
+)
+
+var (
+	ErrInvalidPatch    = errors.New("invalid patch")
+	ErrPatchTestFailed = errors.New("patch test operation failed")
+)
+
+// patchFunc applies a patch to a decoded json document, returning the patched document
+type patchFunc func(doc interface{}) (interface{}, error)
+
+// patchItem applies a patch of the specified media type to the value of an item and validates the result against
+// the schema of the item type; the item is updated with compare-and-swap, if it is changed while the patch is applied
+// the patch is applied again to the new value unless a version was specified, see DataBase.SetItem for its meaning
+// returns any error along with a flag indicating if the patch or the patched value are not valid
+func patchItem(s Store, key, mediaType string, patch []byte, version int64) (error, bool) {
+	apply, err := newPatch(mediaType, patch)
+	if err != nil {
+		return err, true
+	}
+	for attempt := 0; ; attempt++ {
+		item, current, err := s.getVersionedItem(key)
+		if err != nil {
+			return err, false
+		}
+		if version > 0 && current != version {
+			return ErrVersionMismatch, false
+		}
+		doc, err := decodeJson(item.Value)
+		if err != nil {
+			return fmt.Errorf("cannot decode value of item %s: %s", key, err), false
+		}
+		if doc, err = apply(doc); err != nil {
+			return err, true
+		}
+		value, err := json.Marshal(doc)
+		if err != nil {
+			return err, false
+		}
+		err, isValidationError := s.SetItem(key, item.Type, string(value), current)
+		if err == ErrVersionMismatch && version <= 0 && attempt < patchRetries {
+			continue
+		}
+		return err, isValidationError
+	}
+}
+
+// newPatch parses a patch document of the specified media type
+func newPatch(mediaType string, patch []byte) (patchFunc, error) {
+	switch mediaType {
+	case mergePatchType:
+		p, err := decodeJson(patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+		}
+		return func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, p), nil
+		}, nil
+	case jsonPatchType:
+		var ops []patchOperation
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+		}
+		for i := range ops {
+			if err := ops[i].parse(); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %s", ErrInvalidPatch, i, err)
+			}
+		}
+		return func(doc interface{}) (interface{}, error) {
+			var err error
+			for i := range ops {
+				if doc, err = ops[i].apply(doc); err != nil {
+					if errors.Is(err, ErrPatchTestFailed) {
+						return nil, fmt.Errorf("operation %d: %w", i, err)
+					}
+					return nil, fmt.Errorf("%w: operation %d: %s", ErrInvalidPatch, i, err)
+				}
+			}
+			return doc, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported patch media type '%s', expected %s or %s", mediaType, mergePatchType, jsonPatchType)
+}
+
+// decodeJson decodes a json document keeping numbers as written
+func decodeJson(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after json document")
+	}
+	return v, nil
+}
+
+// mergePatch applies a JSON Merge Patch to a decoded json document
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// patchOperation an operation of a JSON Patch
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+	path  []string
+	from  []string
+	value interface{}
+}
+
+// parse checks the members required by the operation are present and parses them
+func (o *patchOperation) parse() error {
+	var err error
+	if o.Path == nil {
+		return fmt.Errorf("missing path")
+	}
+	if o.path, err = parsePointer(*o.Path); err != nil {
+		return err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return fmt.Errorf("missing value for %s", o.Op)
+		}
+		if o.value, err = decodeJson(o.Value); err != nil {
+			return err
+		}
+	case "move", "copy":
+		if o.From == nil {
+			return fmt.Errorf("missing from for %s", o.Op)
+		}
+		if o.from, err = parsePointer(*o.From); err != nil {
+			return err
+		}
+		if o.Op == "move" && len(o.from) < len(o.path) && strings.HasPrefix(*o.Path, *o.From+"/") {
+			return fmt.Errorf("cannot move '%s' into one of its children", *o.From)
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation '%s'", o.Op)
+	}
+	return nil
+}
+
+// apply applies the operation to a decoded json document, which can be changed in place
+func (o *patchOperation) apply(doc interface{}) (interface{}, error) {
+	switch o.Op {
+	case "add":
+		return addValue(doc, o.path, copyJson(o.value))
+	case "remove":
+		doc, _, err := removeValue(doc, o.path)
+		return doc, err
+	case "replace":
+		doc, _, err := removeValue(doc, o.path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, o.path, copyJson(o.value))
+	case "move":
+		doc, value, err := removeValue(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, o.path, value)
+	case "copy":
+		value, found := resolvePath(doc, o.from)
+		if !found {
+			return nil, fmt.Errorf("path '%s' not found", *o.From)
+		}
+		return addValue(doc, o.path, copyJson(value))
+	case "test":
+		value, found := resolvePath(doc, o.path)
+		if !found || !jsonEqual(value, o.value) {
+			return nil, fmt.Errorf("%w: the value at '%s' is not %s", ErrPatchTestFailed, *o.Path, o.Value)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation '%s'", o.Op)
+}
+
+// addValue adds a value at a path, inserting it into arrays
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return changeAt(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add '%s' to a value that is neither an object nor an array", token)
+	})
+}
+
+// removeValue removes the value at a path, which must exist, and returns it
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	var removed interface{}
+	doc, err := changeAt(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			v, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("path '%s' not found", pointerString(path))
+			}
+			removed = v
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("path '%s' not found", pointerString(path))
+	})
+	return doc, removed, err
+}
+
+// changeAt applies a change to the object or array holding the last token of a path, which must exist, replacing
+// the containers on the path with their changed versions as arrays can be reallocated
+func changeAt(node interface{}, path []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path '%s' not found", pointerString(path[:1]))
+		}
+		updated, err := changeAt(child, path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = updated
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(n), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := changeAt(n[i], path[1:], change)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	}
+	return nil, fmt.Errorf("path '%s' not found", pointerString(path[:1]))
+}
+
+// arrayIndex parses an array index token, "-" refers to the end of the array where allowed
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	// indexes have no sign or leading zeros
+	if len(token) == 0 || (len(token) > 1 && token[0] == '0') || strings.IndexFunc(token, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return 0, fmt.Errorf("invalid array index '%s'", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i > length || (i == length && !end) {
+		return 0, fmt.Errorf("array index %s out of bounds", token)
+	}
+	return i, nil
+}
+
+// copyJson deep copies a decoded json value
+func copyJson(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			c[k] = copyJson(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(x))
+		for i, e := range x {
+			c[i] = copyJson(e)
+		}
+		return c
+	}
+	return v
+}
+
+// jsonEqual true if two decoded json values are equal, numbers being compared by value
+func jsonEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, e := range x {
+			f, ok := y[k]
+			if !ok || !jsonEqual(e, f) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	return a == b
+}
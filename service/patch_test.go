@@ -0,0 +1,119 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	cases := []struct {
+		mediaType, doc, patch, expected string
+		err                             error
+	}{
+		// RFC 7386 examples
+		{mergePatchType, `{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`, nil},
+		{mergePatchType, `{"a":"b"}`, `{"a":null}`, `{}`, nil},
+		{mergePatchType, `{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`, nil},
+		{mergePatchType, `{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`, nil},
+		{mergePatchType, `{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`, nil},
+		{mergePatchType, `{"a":"foo"}`, `"bar"`, `"bar"`, nil},
+		{mergePatchType, `{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`, nil},
+		{mergePatchType, `{}`, `{"a":`, ``, ErrInvalidPatch},
+		// RFC 6902 examples
+		{jsonPatchType, `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, nil},
+		{jsonPatchType, `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, nil},
+		{jsonPatchType, `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc"]}]`, `{"foo":["bar",["abc"]]}`, nil},
+		{jsonPatchType, `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, nil},
+		{jsonPatchType, `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, nil},
+		{jsonPatchType, `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, nil},
+		{jsonPatchType, `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, nil},
+		{jsonPatchType, `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, nil},
+		{jsonPatchType, `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`, nil},
+		{jsonPatchType, `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, ErrPatchTestFailed},
+		{jsonPatchType, `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`, nil},
+		{jsonPatchType, `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, ErrInvalidPatch},
+		{jsonPatchType, `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/01","value":"qux"}]`, ``, ErrInvalidPatch},
+		{jsonPatchType, `{"foo":null}`, `[{"op":"test","path":"/foo","value":null}]`, `{"foo":null}`, nil},
+		{jsonPatchType, `{"foo":"bar"}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"","value":[1]}]`, `[1]`, nil},
+		{jsonPatchType, `{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, ``, ErrInvalidPatch},
+		{jsonPatchType, `{"foo":1}`, `[{"op":"add","path":"/bar"}]`, ``, ErrInvalidPatch},
+		{jsonPatchType, `{"foo":1}`, `[{"op":"frobnicate","path":"/bar"}]`, ``, ErrInvalidPatch},
+		// numbers keep their precision
+		{jsonPatchType, `{"id":12345678901234567890}`, `[{"op":"add","path":"/n","value":1.50}]`, `{"id":12345678901234567890,"n":1.50}`, nil},
+	}
+	for _, c := range cases {
+		var (
+			doc    interface{}
+			result []byte
+		)
+		apply, err := newPatch(c.mediaType, []byte(c.patch))
+		if err == nil {
+			if doc, err = decodeJson([]byte(c.doc)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if doc, err = apply(doc); err == nil {
+				result, _ = json.Marshal(doc)
+			}
+		}
+		if c.err != nil {
+			if !errors.Is(err, c.err) {
+				t.Fatalf("patch %s of %s: expected %v, got %v", c.patch, c.doc, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("patch %s of %s: %s", c.patch, c.doc, err)
+		}
+		if string(result) != c.expected {
+			t.Fatalf("patch %s of %s: expected %s, got %s", c.patch, c.doc, c.expected, result)
+		}
+	}
+}
+
+func TestPatchItem(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.setTypeFromString("kv", []byte(`{"type":"object","required":["key","value"]}`), []byte(`{}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err, _ := s.SetItem("config", "kv", `{"key":"k","value":"v1"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err, _ := patchItem(s, "config", mergePatchType, []byte(`{"value":"v2","extra":true}`), 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			i, version, err := s.getVersionedItem("config")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if i.Type != "kv" || string(i.Value) != `{"extra":true,"key":"k","value":"v2"}` {
+				t.Fatalf("unexpected patched item %s %s", i.Type, i.Value)
+			}
+			// the patched value must satisfy the schema of the type
+			if err, isValidationError := patchItem(s, "config", jsonPatchType, []byte(`[{"op":"remove","path":"/key"}]`), 0); err == nil || !isValidationError {
+				t.Fatalf("expected a validation error, got %v", err)
+			}
+			if err, _ := patchItem(s, "config", jsonPatchType, []byte(`[{"op":"remove","path":"/extra"}]`), version-1); err != ErrVersionMismatch {
+				t.Fatalf("expected version mismatch, got %v", err)
+			}
+			if err, _ := patchItem(s, "config", jsonPatchType, []byte(`[{"op":"remove","path":"/extra"}]`), version); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if i, _ = s.getItem("config"); string(i.Value) != `{"key":"k","value":"v2"}` {
+				t.Fatalf("unexpected patched item %s", i.Value)
+			}
+			if err, _ := patchItem(s, "missing", mergePatchType, []byte(`{}`), 0); err != ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"southwinds.dev/source_client"
+	"strings"
+)
+
+// fieldProjection the paths of the fields kept in item values, other fields are removed
+type fieldProjection [][]string
+
+// parseFields parses the fields query parameters, each a comma separated list of JSONPath or JSON Pointer paths
+func parseFields(values []string) (fieldProjection, error) {
+	var p fieldProjection
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); len(field) == 0 {
+				continue
+			}
+			path, err := parsePath(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid field: %s", err)
+			}
+			p = append(p, path)
+		}
+	}
+	return p, nil
+}
+
+// project keeps the selected fields of a json value, along with the objects containing them; a path going through
+// an array keeps the whole array
+func (p fieldProjection) project(value []byte) ([]byte, error) {
+	doc, err := decodeJson(value)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]interface{}{}
+	for _, path := range p {
+		if len(path) == 0 {
+			// the whole value is selected
+			return value, nil
+		}
+		projectPath(out, doc, path)
+	}
+	return json.Marshal(out)
+}
+
+// projectPath copies the member of an object at a path to the same path of another object
+func projectPath(dst map[string]interface{}, node interface{}, path []string) {
+	obj, ok := node.(map[string]interface{})
+	if !ok {
+		return
+	}
+	v, found := obj[path[0]]
+	if !found {
+		return
+	}
+	child, isObject := v.(map[string]interface{})
+	if len(path) == 1 || !isObject {
+		if _, isArray := v.([]interface{}); len(path) == 1 || isArray {
+			dst[path[0]] = v
+		}
+		return
+	}
+	d, isObject := dst[path[0]].(map[string]interface{})
+	if !isObject {
+		d = map[string]interface{}{}
+		dst[path[0]] = d
+	}
+	projectPath(d, child, path[1:])
+}
+
+// apply replaces the values of items with their projections
+func (p fieldProjection) apply(items []src.I) error {
+	for i := range items {
+		value, err := p.project(items[i].Value)
+		if err != nil {
+			return fmt.Errorf("cannot project value of item %s: %s", items[i].Key, err)
+		}
+		items[i].Value = value
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"github.com/gorilla/mux"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProjectFields(t *testing.T) {
+	value := []byte(`{"name":"app","db":{"host":"h","port":5432,"user":{"name":"u"}},"ports":[{"n":80},{"n":443}],"big":12345678901234567890}`)
+	cases := []struct {
+		fields   []string
+		expected string
+	}{
+		{[]string{"/name"}, `{"name":"app"}`},
+		{[]string{"/name,$.db.port", "/big"}, `{"big":12345678901234567890,"db":{"port":5432},"name":"app"}`},
+		{[]string{"$.db.user.name,/db/host"}, `{"db":{"host":"h","user":{"name":"u"}}}`},
+		{[]string{"/db/host,/db"}, `{"db":{"host":"h","port":5432,"user":{"name":"u"}}}`},
+		// arrays are kept whole
+		{[]string{"$.ports[1].n"}, `{"ports":[{"n":80},{"n":443}]}`},
+		// missing fields and fields below scalars are left out
+		{[]string{"/missing,/name/x"}, `{}`},
+		{[]string{"$"}, string(value)},
+	}
+	for _, c := range cases {
+		p, err := parseFields(c.fields)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		actual, err := p.project(value)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if string(actual) != c.expected {
+			t.Fatalf("fields %v: expected %s, got %s", c.fields, c.expected, actual)
+		}
+	}
+	if _, err := parseFields([]string{"name"}); err == nil {
+		t.Fatalf("expected invalid field")
+	}
+}
+
+func TestGetItemValue(t *testing.T) {
+	UseStore(NewMemoryStore())
+	AllowReveal(true)
+	defer AllowReveal(false)
+	if err := db.setTypeFromString("conn", []byte(`{"properties":{"password":{"x-secret":true}}}`), nil); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ := db.SetItem("c1", "conn", `{"host":"db","port":5432,"password":"s3cret","tags":["a"]}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cases := []struct {
+		pointer, query string
+		status         int
+		body           string
+	}{
+		{"host", "", 200, "db"},
+		{"port", "", 200, "5432"},
+		{"tags", "", 200, "[\"a\"]\n"},
+		{"tags/0", "", 200, "a"},
+		{"password", "", 200, secretMask},
+		{"password", "?reveal=true", 200, "s3cret"},
+		{"missing", "", 404, ""},
+	}
+	for _, c := range cases {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/item/c1/value/"+c.pointer+c.query, nil), map[string]string{"key": "c1", "pointer": c.pointer})
+		w := httptest.NewRecorder()
+		GetItemValueHandler(w, r)
+		if w.Code != c.status || (c.status == 200 && w.Body.String() != c.body) {
+			t.Fatalf("pointer %s%s: expected %d %s, got %d %s", c.pointer, c.query, c.status, c.body, w.Code, w.Body.String())
+		}
+		if c.status == 200 && (len(w.Header().Get("ETag")) == 0 || len(w.Header().Get("Last-Modified")) == 0) {
+			t.Fatalf("pointer %s%s: expected the entity tag and last modification time, got %v", c.pointer, c.query, w.Header())
+		}
+	}
+}
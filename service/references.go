@@ -0,0 +1,258 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"southwinds.dev/source_client"
+	"strings"
+)
+
+const (
+	// refScheme the scheme of references to other items, e.g. {"$ref": "item://shared-db#/host"}
+	refScheme = "item://"
+	// refRel the kind of the links recorded from items to the items they reference
+	refRel = "references"
+	// maxRefDepth the maximum number of nested references resolved
+	maxRefDepth = 32
+)
+
+var (
+	ErrDanglingRef = errors.New("dangling reference")
+	ErrRefCycle    = errors.New("reference cycle")
+	ErrInvalidRef  = errors.New("invalid reference")
+)
+
+// itemRef a reference to the value, or part of the value, of an item
+type itemRef struct {
+	key  string
+	path []string
+}
+
+// String the reference as written in item values
+func (r itemRef) String() string {
+	if len(r.path) == 0 {
+		return refScheme + r.key
+	}
+	return refScheme + r.key + "#" + pointerString(r.path)
+}
+
+// asRef the reference represented by a json node, an object having an item reference as its only member "$ref"
+func asRef(node interface{}) (itemRef, bool, error) {
+	obj, ok := node.(map[string]interface{})
+	if !ok || len(obj) != 1 {
+		return itemRef{}, false, nil
+	}
+	s, ok := obj["$ref"].(string)
+	if !ok || !strings.HasPrefix(s, refScheme) {
+		return itemRef{}, false, nil
+	}
+	key, fragment, _ := strings.Cut(s[len(refScheme):], "#")
+	key, err := url.PathUnescape(key)
+	if err != nil || len(key) == 0 {
+		return itemRef{}, true, fmt.Errorf("%w '%s': missing item key", ErrInvalidRef, s)
+	}
+	if fragment, err = url.PathUnescape(fragment); err != nil {
+		return itemRef{}, true, fmt.Errorf("%w '%s': %s", ErrInvalidRef, s, err)
+	}
+	path, err := parsePointer(fragment)
+	if err != nil {
+		return itemRef{}, true, fmt.Errorf("%w '%s': %s", ErrInvalidRef, s, err)
+	}
+	return itemRef{key: key, path: path}, true, nil
+}
+
+// walkRefs calls a function for each reference in a decoded json document, replacing the reference by the value
+// returned
+func walkRefs(node interface{}, f func(ref itemRef) (interface{}, error)) (interface{}, error) {
+	ref, isRef, err := asRef(node)
+	if err != nil {
+		return nil, err
+	}
+	if isRef {
+		return f(ref)
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if n[k], err = walkRefs(v, f); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, v := range n {
+			if n[i], err = walkRefs(v, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return node, nil
+}
+
+// referencedItems the keys of the other items referenced by an item value, invalid references are ignored
+func referencedItems(key string, value []byte) []string {
+	doc, err := decodeJson(value)
+	if err != nil {
+		return nil
+	}
+	found := map[string]bool{}
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		if ref, isRef, _ := asRef(node); isRef {
+			if len(ref.key) > 0 && ref.key != key {
+				found[ref.key] = true
+			}
+			return
+		}
+		switch n := node.(type) {
+		case map[string]interface{}:
+			for _, v := range n {
+				walk(v)
+			}
+		case []interface{}:
+			for _, v := range n {
+				walk(v)
+			}
+		}
+	}
+	walk(doc)
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// linkReferences replaces the references recorded from an item and links it to the items it references, references
+// to items that do not exist are linked when those items are created
+func linkReferences(ctx context.Context, tx *sqlTx, key string, value []byte) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM item_reference WHERE from_key = ?;`, key); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM link WHERE from_key = ? AND rel = ?;`, key, refRel); err != nil {
+		return err
+	}
+	for _, ref := range referencedItems(key, value) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO item_reference(from_key, to_key) VALUES(?, ?);`, key, ref); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO link(from_key, to_key, rel) SELECT ?, key, ? FROM item WHERE key = ? ON CONFLICT(from_key, to_key, rel) DO NOTHING;`, key, refRel, ref); err != nil {
+			return err
+		}
+	}
+	// links the items that referenced the item before it was created
+	_, err := tx.ExecContext(ctx, `INSERT INTO link(from_key, to_key, rel) SELECT from_key, to_key, ? FROM item_reference WHERE to_key = ? ON CONFLICT(from_key, to_key, rel) DO NOTHING;`, refRel, key)
+	return err
+}
+
+// unresolvable true if an error is due to a reference that cannot be resolved
+func unresolvable(err error) bool {
+	return errors.Is(err, ErrDanglingRef) || errors.Is(err, ErrRefCycle) || errors.Is(err, ErrInvalidRef)
+}
+
+// refResolver resolves the references in item values, masking the secrets of the items referenced
+type refResolver struct {
+	store  Store
+	masker *secretMasker
+	// docs the decoded values of the items loaded, by key
+	docs map[string]interface{}
+	// resolved the values of the references resolved, by reference, so that each one is resolved once however many
+	// times it is referenced; they contain no references and are never walked again, so they can be shared
+	resolved map[string]interface{}
+	// stack the references being resolved
+	stack []string
+}
+
+func newRefResolver(s Store, masker *secretMasker) *refResolver {
+	return &refResolver{store: s, masker: masker, docs: map[string]interface{}{}, resolved: map[string]interface{}{}}
+}
+
+// resolveItem replaces the references in the value of an item by the values they refer to, recursively
+func (r *refResolver) resolveItem(item *src.I) error {
+	doc, err := decodeJson(item.Value)
+	if err != nil {
+		return fmt.Errorf("cannot decode item %s: %s", item.Key, err)
+	}
+	r.docs[item.Key] = doc
+	root := itemRef{key: item.Key}
+	r.stack = append(r.stack, root.String())
+	resolved, err := walkRefs(copyJson(doc), r.deref)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(resolved)
+	if err != nil {
+		return err
+	}
+	item.Value = value
+	return nil
+}
+
+// deref the resolved value a reference refers to
+func (r *refResolver) deref(ref itemRef) (interface{}, error) {
+	id := ref.String()
+	if value, ok := r.resolved[id]; ok {
+		return value, nil
+	}
+	for i, s := range r.stack {
+		if s == id {
+			return nil, fmt.Errorf("%w: %s", ErrRefCycle, strings.Join(append(append([]string{}, r.stack[i:]...), id), " -> "))
+		}
+	}
+	if len(r.stack) >= maxRefDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d levels: %s", ErrInvalidRef, maxRefDepth, strings.Join(r.stack, " -> "))
+	}
+	doc, err := r.load(ref.key)
+	if err != nil {
+		return nil, err
+	}
+	value, found := resolvePath(doc, ref.path)
+	if !found {
+		return nil, fmt.Errorf("%w: '%s' not found in item '%s', referenced from %s", ErrDanglingRef, pointerString(ref.path), ref.key, r.stack[len(r.stack)-1])
+	}
+	r.stack = append(r.stack, id)
+	resolved, err := walkRefs(copyJson(value), r.deref)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return nil, err
+	}
+	r.resolved[id] = resolved
+	return resolved, nil
+}
+
+// load the decoded and masked value of an item
+func (r *refResolver) load(key string) (interface{}, error) {
+	if doc, ok := r.docs[key]; ok {
+		return doc, nil
+	}
+	item, err := r.store.getItem(key)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("%w: item '%s' not found, referenced from %s", ErrDanglingRef, key, r.stack[len(r.stack)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.masker.mask(item.Type, item.Value)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeJson(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode item %s: %s", key, err)
+	}
+	r.docs[key] = doc
+	return doc, nil
+}
@@ -0,0 +1,190 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestResolveReferences(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.setTypeFromString("db", []byte(`{"properties":{"password":{"x-secret":true}}}`), []byte(`{}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			items := []struct{ key, iType, value string }{
+				{"shared-db", "db", `{"host":"db.local","port":5432,"password":"s3cret"}`},
+				{"defaults", "", `{"port":{"$ref":"item://shared-db#/port"},"timeout":30}`},
+				{"app", "", `{"db":{"host":{"$ref":"item://shared-db#/host"},"port":{"$ref":"item://defaults#/port"},"password":{"$ref":"item://shared-db#/password"}},"all":[{"$ref":"item://defaults"}],"self":{"$ref":"item://app#/db/host"}}`},
+				{"dangling", "", `{"a":{"$ref":"item://missing#/x"}}`},
+				{"cycle-a", "", `{"b":{"$ref":"item://cycle-b#/a"}}`},
+				{"cycle-b", "", `{"a":{"$ref":"item://cycle-a#/b"}}`},
+				{"bad-pointer", "", `{"a":{"$ref":"item://shared-db#/nothing"}}`},
+			}
+			for _, i := range items {
+				if err, _ := s.SetItem(i.key, i.iType, i.value, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			resolve := func(key string, masker *secretMasker) (string, error) {
+				item, err := s.getItem(key)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				err = newRefResolver(s, masker).resolveItem(item)
+				return string(item.Value), err
+			}
+			value, err := resolve("app", &secretMasker{store: s, paths: map[string][][]string{}})
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			// the secrets of the items referenced are masked
+			expected := `{"all":[{"port":5432,"timeout":30}],"db":{"host":"db.local","password":"********","port":5432},"self":"db.local"}`
+			if value != expected {
+				t.Fatalf("expected %s, got %s", expected, value)
+			}
+			if value, _ = resolve("app", nil); value != `{"all":[{"port":5432,"timeout":30}],"db":{"host":"db.local","password":"s3cret","port":5432},"self":"db.local"}` {
+				t.Fatalf("unexpected revealed value %s", value)
+			}
+			if _, err = resolve("dangling", nil); !errors.Is(err, ErrDanglingRef) {
+				t.Fatalf("expected dangling reference, got %v", err)
+			}
+			if _, err = resolve("bad-pointer", nil); !errors.Is(err, ErrDanglingRef) {
+				t.Fatalf("expected dangling reference, got %v", err)
+			}
+			if _, err = resolve("cycle-a", nil); !errors.Is(err, ErrRefCycle) {
+				t.Fatalf("expected reference cycle, got %v", err)
+			}
+			// references to existing items are recorded as links
+			parents, err := s.getParents("shared-db", refRel)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(parents) != 3 {
+				t.Fatalf("expected app, bad-pointer and defaults to reference shared-db, got %d items", len(parents))
+			}
+			if err, _ = s.SetItem("app", "", `{"db":"inline"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if children, _ := s.getChildren("app", refRel); len(children) != 0 {
+				t.Fatalf("expected the reference links of app to be removed, got %d", len(children))
+			}
+		})
+	}
+}
+
+func TestCascadeDeleteKeepsReferencedItems(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			items := []struct{ key, value string }{
+				{"shared-db", `{"host":"db.local"}`},
+				{"app", `{"db":{"$ref":"item://shared-db#/host"}}`},
+				{"app-config", `{"debug":true}`},
+			}
+			for _, i := range items {
+				if err, _ := s.SetItem(i.key, "", i.value, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			if err := s.Link("app", "app-config", "", nil); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err := s.DeleteItem("app", 0, deleteOptions{cascade: true}); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for _, key := range []string{"app", "app-config"} {
+				if _, err := s.getItem(key); err != ErrNotFound {
+					t.Fatalf("expected %s to be deleted, got %v", key, err)
+				}
+			}
+			// the item referenced is not a child of the item deleted
+			if _, err := s.getItem("shared-db"); err != nil {
+				t.Fatalf("expected shared-db to remain, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveSharedReferencesOnce(t *testing.T) {
+	s := NewMemoryStore()
+	// each level references the previous one twice, resolving every reference would take 2^levels lookups
+	const levels = 12
+	if err, _ := s.SetItem("level-0", "", `{"value":1}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for i := 1; i <= levels; i++ {
+		value := fmt.Sprintf(`{"a":{"$ref":"item://level-%d"},"b":{"$ref":"item://level-%d"}}`, i-1, i-1)
+		if err, _ := s.SetItem(fmt.Sprintf("level-%d", i), "", value, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	item, err := s.getItem(fmt.Sprintf("level-%d", levels))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	r := newRefResolver(s, nil)
+	if err = r.resolveItem(item); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(r.resolved) != levels {
+		t.Fatalf("expected the %d items referenced to be resolved once each, got %d resolved", levels, len(r.resolved))
+	}
+	if !strings.HasPrefix(string(item.Value), `{"a":{"a":{"a":`) {
+		t.Fatalf("unexpected resolved value %.40s", item.Value)
+	}
+}
+
+func TestLinkReferencesToItemsCreatedLater(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err, _ := s.SetItem("app", "", `{"db":{"$ref":"item://shared-db#/host"}}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if children, _ := s.getChildren("app", refRel); len(children) != 0 {
+				t.Fatalf("expected no link to a missing item, got %d", len(children))
+			}
+			if err, _ := s.SetItem("shared-db", "", `{"host":"db.local"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			parents, err := s.getParents("shared-db", refRel)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(parents) != 1 || parents[0].Key != "app" {
+				t.Fatalf("expected app to reference shared-db once created, got %v", parents)
+			}
+			// the link is recorded again when the referenced item is created again
+			if err = s.DeleteItem("shared-db", 0, deleteOptions{}); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err, _ = s.SetItem("shared-db", "", `{"host":"db.local"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if parents, _ = s.getParents("shared-db", refRel); len(parents) != 1 {
+				t.Fatalf("expected app to reference shared-db once created again, got %d items", len(parents))
+			}
+			// references removed from the referencing item are no longer linked
+			if err, _ = s.SetItem("app", "", `{"db":"inline"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err = s.DeleteItem("shared-db", 0, deleteOptions{}); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err, _ = s.SetItem("shared-db", "", `{"host":"db.local"}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if parents, _ = s.getParents("shared-db", refRel); len(parents) != 0 {
+				t.Fatalf("expected no item to reference shared-db, got %d items", len(parents))
+			}
+		})
+	}
+}
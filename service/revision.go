@@ -0,0 +1,140 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultRetention the number of revisions kept for an item when its type does not define a retention limit
+const defaultRetention = 10
+
+// Revision a value previously written to a configuration item
+type Revision struct {
+	Key      string          `json:"key"`
+	Revision int64           `json:"revision"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Updated  time.Time       `json:"updated"`
+}
+
+// addRevision records an encrypted value as a revision of an item and prunes revisions beyond the retention limit of
+// the item type, the revision number is the version of the item the value was written as
+func addRevision(ctx context.Context, tx *sqlTx, key, iType string, value []byte, updated, revision int64) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO item_revision(item_key, revision, type, value, updated) VALUES(?, ?, ?, ?, ?);`, key, revision, iType, value, updated)
+	if err != nil {
+		return err
+	}
+	retention := int64(defaultRetention)
+	var limit sql.NullInt64
+	err = tx.QueryRowContext(ctx, `SELECT retention FROM type WHERE key = ?;`, iType).Scan(&limit)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if limit.Valid {
+		retention = limit.Int64
+	}
+	// a retention of zero or less keeps all revisions
+	if retention <= 0 {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM item_revision WHERE item_key = ? AND revision <= ?;`, key, revision-retention)
+	return err
+}
+
+// setTypeRetention set the number of revisions kept for items of the specified type, zero keeps all revisions
+func (d *DataBase) setTypeRetention(key string, retention int) error {
+	result, err := d.db.Exec(`UPDATE type SET retention = ? WHERE key = ?;`, retention, key)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrItemTypeNotFound
+	}
+	return nil
+}
+
+// getItemHistory get the revisions kept for an item, newest first, without their values
+func (d *DataBase) getItemHistory(key string) ([]Revision, error) {
+	row, err := d.db.Query(`SELECT revision, type, updated FROM item_revision WHERE item_key = ? ORDER BY revision DESC;`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer func(row *sql.Rows) {
+		err = row.Close()
+		if err != nil {
+			fmt.Printf("cannot close query row: %s\n", err)
+		}
+	}(row)
+	var (
+		revision  int64
+		iType     string
+		updated   sql.NullInt64
+		revisions []Revision
+	)
+	for row.Next() {
+		if err = row.Scan(&revision, &iType, &updated); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, Revision{
+			Key:      key,
+			Revision: revision,
+			Type:     iType,
+			Updated:  time.Unix(0, updated.Int64).UTC(),
+		})
+	}
+	if len(revisions) == 0 {
+		return nil, ErrNotFound
+	}
+	return revisions, nil
+}
+
+// getItemRevision get a specific revision of an item including its value
+func (d *DataBase) getItemRevision(key string, revision int64) (*Revision, error) {
+	row := d.db.QueryRow(`SELECT r.type, r.value, r.updated, (SELECT k.wrapped FROM data_key k WHERE k.item_key = r.item_key) FROM item_revision r WHERE r.item_key = ? AND r.revision = ?;`, key, revision)
+	var (
+		iType   string
+		value   []byte
+		updated sql.NullInt64
+		wrapped []byte
+	)
+	err := row.Scan(&iType, &value, &updated, &wrapped)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows") {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	vv, err := openValue(key, iType, wrapped, value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt revision %d of item %s: %w", revision, key, err)
+	}
+	return &Revision{
+		Key:      key,
+		Revision: revision,
+		Type:     iType,
+		Value:    vv,
+		Updated:  time.Unix(0, updated.Int64).UTC(),
+	}, nil
+}
+
+// rollbackItem set the value of an item back to the value of the specified revision
+// the rollback is written as a new revision, so it can itself be rolled back
+func rollbackItem(s Store, key string, revision int64) (error, bool) {
+	rev, err := s.getItemRevision(key, revision)
+	if err != nil {
+		return err, false
+	}
+	return s.SetItem(key, rev.Type, string(rev.Value), 0)
+}
@@ -0,0 +1,154 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	for name, d := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testRevisions(t, d)
+		})
+	}
+}
+
+func testRevisions(t *testing.T, d Store) {
+	err := d.setTypeFromString("kv", []byte(`{"type":"object","required":["key","value"]}`), []byte(`{"key":"k","value":"v"}`))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// keeps only the last two revisions
+	if err = d.setTypeRetention("kv", 2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if err, _ = d.SetItem("test", "kv", testV{Key: "k", Value: v}, 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	history, err := d.getItemHistory("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(history) != 2 || history[0].Revision != 3 || history[1].Revision != 2 {
+		t.Fatalf("expected revisions 3 and 2, got %+v", history)
+	}
+	// rollback to revision 2 is written as revision 4
+	if err, _ = rollbackItem(d, "test", 2); err != nil {
+		t.Fatalf(err.Error())
+	}
+	i, err := d.getItem("test")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(i.Value) != `{"key":"k","value":"v2"}` {
+		t.Fatalf("unexpected value after rollback: %s", i.Value)
+	}
+	if _, err = d.getItemRevision("test", 4); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// deleting the item removes its history
+	if err = d.DeleteItem("test", 0, deleteOptions{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.getItemHistory("test"); err != ErrNotFound {
+		t.Fatalf("expected history to be removed, got %v", err)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	for name, d := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testCompareAndSwap(t, d)
+		})
+	}
+}
+
+func testCompareAndSwap(t *testing.T, d Store) {
+	err := d.setTypeFromString("kv", []byte(`{"type":"object"}`), []byte(`{}`))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// the item must exist for anyVersion
+	if err, _ = d.SetItem("cas", "", `{"a":1}`, anyVersion); err != ErrVersionMismatch {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if err, _ = d.SetItem("cas", "", `{"a":1}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, version, err := d.getVersionedItem("cas")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("cas", "", `{"a":2}`, version); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// a second writer holding the old version loses
+	if err, _ = d.SetItem("cas", "", `{"a":3}`, version); err != ErrVersionMismatch {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if err = d.DeleteItem("cas", version, deleteOptions{}); err != ErrVersionMismatch {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if err = d.DeleteItem("cas", version+1, deleteOptions{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// versions keep rising when an item is deleted and created again, so older versions never match
+	if err, _ = d.SetItem("cas", "", `{"a":1}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("cas", "", `{"a":2}`, version); err != ErrVersionMismatch {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+	if _, recreated, _ := d.getVersionedItem("cas"); recreated != version+2 {
+		t.Fatalf("expected version %d, got %d", version+2, recreated)
+	}
+	// as well as when the item is popped
+	if err, _ = d.SetItem("queued", "kv", `{"key":"k","value":"v"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.popOldestByType("kv"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err, _ = d.SetItem("queued", "kv", `{"key":"k","value":"v"}`, 0); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, queued, _ := d.getVersionedItem("queued"); queued != 2 {
+		t.Fatalf("expected version 2, got %d", queued)
+	}
+}
+
+// testStores the stores the backend independent tests run against
+// set SOURCE_TEST_DB_URL to also run them against a disposable PostgreSQL database, its tables are emptied by the tests
+func testStores(t *testing.T) map[string]Store {
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	stores := map[string]Store{
+		"sqlite": d,
+		"memory": NewMemoryStore(),
+	}
+	if url := os.Getenv("SOURCE_TEST_DB_URL"); len(url) > 0 {
+		pg, err := newPgDb(url)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, table := range []string{"item", "item_revision", "item_deleted", "item_last_version", "data_key", "item_field", "tag", "link", "type", "type_version"} {
+			if _, err = pg.db.Exec("DELETE FROM " + table + ";"); err != nil {
+				t.Fatalf(err.Error())
+			}
+		}
+		stores["postgres"] = pg
+	}
+	return stores
+}
@@ -0,0 +1,204 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// rotationBatchSize the number of data keys rewrapped in each transaction during a key rotation
+const rotationBatchSize = 100
+
+var ErrRotationRunning = errors.New("a key rotation is already running")
+
+// KeyRotation the progress of rewrapping item data keys with the active master key
+type KeyRotation struct {
+	// State either running, completed or failed
+	State string `json:"state"`
+	// KeyId the identifier of the master key data keys are rewrapped with
+	KeyId string `json:"keyId"`
+	// Total the number of data keys at the start of the rotation
+	Total int64 `json:"total"`
+	// Processed the number of data keys checked so far
+	Processed int64 `json:"processed"`
+	// Rewrapped the number of data keys rewrapped so far
+	Rewrapped int64 `json:"rewrapped"`
+	// Failed the number of data keys that could not be decrypted
+	Failed  int64      `json:"failed"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// keyRotator implemented by stores encrypting values at rest
+type keyRotator interface {
+	// rotateKeys start rewrapping item data keys with the active master key in the background
+	rotateKeys() (*KeyRotation, error)
+	// keyRotation get the progress of the last key rotation, nil if no rotation has been started
+	keyRotation() *KeyRotation
+}
+
+// rotationTracker tracks the progress of a key rotation, allowing it to be read while the rotation runs
+type rotationTracker struct {
+	lock    sync.Mutex
+	current *KeyRotation
+}
+
+// start records the start of a rotation unless one is already running
+func (t *rotationTracker) start(total int64) (*KeyRotation, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current != nil && t.current.State == "running" {
+		return nil, ErrRotationRunning
+	}
+	t.current = &KeyRotation{
+		State:   "running",
+		KeyId:   keys.active.KeyId(),
+		Total:   total,
+		Started: time.Now().UTC(),
+	}
+	c := *t.current
+	return &c, nil
+}
+
+// update applies a change to the progress of the running rotation
+func (t *rotationTracker) update(f func(r *KeyRotation)) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f(t.current)
+}
+
+// get a copy of the progress of the last rotation
+func (t *rotationTracker) get() *KeyRotation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.current == nil {
+		return nil
+	}
+	c := *t.current
+	return &c
+}
+
+// rotateKeys start rewrapping the data keys of items with the active master key in batches, so that the service stays
+// available whilst the rotation runs; data keys created in the meantime are already wrapped with the active key
+func (d *DataBase) rotateKeys() (*KeyRotation, error) {
+	if keys == nil {
+		return nil, ErrNoKey
+	}
+	var total int64
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM data_key;`).Scan(&total); err != nil {
+		return nil, err
+	}
+	r, err := d.rotation.start(total)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := d.rewrapDataKeys()
+		d.rotation.update(func(r *KeyRotation) {
+			ended := time.Now().UTC()
+			r.Ended = &ended
+			switch {
+			case err != nil:
+				r.State = "failed"
+				r.Error = err.Error()
+			case r.Failed > 0:
+				r.State = "failed"
+				r.Error = fmt.Sprintf("%d data keys could not be decrypted with the configured keys", r.Failed)
+			default:
+				r.State = "completed"
+			}
+		})
+		if err != nil {
+			log.Printf("key rotation failed: %s\n", err)
+		}
+	}()
+	return r, nil
+}
+
+// keyRotation get the progress of the last key rotation
+func (d *DataBase) keyRotation() *KeyRotation {
+	return d.rotation.get()
+}
+
+// rewrapDataKeys rewraps item data keys in batches ordered by item key
+func (d *DataBase) rewrapDataKeys() error {
+	last := ""
+	for {
+		tx, err := d.db.BeginTx(context.Background(), nil)
+		if err != nil {
+			return err
+		}
+		rows, err := tx.Query(`SELECT item_key, wrapped FROM data_key WHERE item_key > ? ORDER BY item_key LIMIT ?;`, last, rotationBatchSize)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		type row struct {
+			key     string
+			wrapped []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var r row
+			if err = rows.Scan(&r.key, &r.wrapped); err != nil {
+				break
+			}
+			batch = append(batch, r)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		_ = rows.Close()
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		var rewrapped, failed int64
+		for _, r := range batch {
+			if activeKeyEncrypted(r.wrapped) {
+				continue
+			}
+			dek, err := unwrapItemKey(r.key, r.wrapped)
+			if err != nil {
+				log.Printf("cannot rewrap data key of item '%s': %s\n", r.key, err)
+				failed++
+				continue
+			}
+			wrapped, err := encrypt(dek, keyData(r.key))
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			// a data key destroyed since it was read is not recreated as the update matches no rows
+			if _, err = tx.Exec(`UPDATE data_key SET wrapped = ? WHERE item_key = ?;`, wrapped, r.key); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			rewrapped++
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		d.rotation.update(func(p *KeyRotation) {
+			p.Processed += int64(len(batch))
+			p.Rewrapped += rewrapped
+			p.Failed += failed
+		})
+		if len(batch) < rotationBatchSize {
+			return nil
+		}
+		last = batch[len(batch)-1].key
+	}
+}
@@ -0,0 +1,67 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRotateKeys(t *testing.T) {
+	defer func() {
+		_ = SetKeyProvider(testKey{})
+	}()
+	d, err := newDb(t.TempDir())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	// more items than fit in a batch
+	for i := 0; i < rotationBatchSize+10; i++ {
+		if err, _ = d.SetItem(fmt.Sprintf("item-%03d", i), "", fmt.Sprintf(`{"n":%d}`, i), 0); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	// activates a new key keeping the previous one for decryption only
+	if err = SetKeyProvider(keyMaterial("source-rotated-encryption-key")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = AddRetiredKey(testKey{}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.rotateKeys(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for d.keyRotation().State == "running" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rotation := d.keyRotation()
+	if rotation.State != "completed" || rotation.Rewrapped != rotation.Total {
+		t.Fatalf("unexpected rotation result %+v", rotation)
+	}
+	// the previous key is no longer needed
+	if err = SetKeyProvider(keyMaterial("source-rotated-encryption-key")); err != nil {
+		t.Fatalf(err.Error())
+	}
+	item, err := d.getItem("item-042")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if string(item.Value) != `{"n":42}` {
+		t.Fatalf("unexpected value %s", item.Value)
+	}
+	history, err := d.getItemHistory("item-042")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err = d.getItemRevision("item-042", history[0].Revision); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
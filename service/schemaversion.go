@@ -0,0 +1,397 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	schemaValidation "github.com/qri-io/jsonschema"
+	"sort"
+	"strings"
+	"time"
+)
+
+// compatibility modes of new versions of a type schema, as in schema registries
+const (
+	// compatBackward the new schema accepts the values accepted by the current one, so existing items remain valid
+	compatBackward = "backward"
+	// compatForward the current schema accepts the values accepted by the new one, so existing readers understand new items
+	compatForward = "forward"
+	// compatFull both backward and forward compatible
+	compatFull = "full"
+	// compatNone no compatibility check
+	compatNone = "none"
+)
+
+var compatibilityModes = []string{compatBackward, compatForward, compatFull, compatNone}
+
+var (
+	ErrInvalidSchema      = errors.New("invalid json schema")
+	ErrIncompatibleSchema = errors.New("incompatible schema change")
+)
+
+// TypeVersion a version of the schema of an item type
+type TypeVersion struct {
+	// Type the key of the item type
+	Type string `json:"type"`
+	// Version the version number, starting at 1
+	Version int64 `json:"version"`
+	// Schema the json schema of the version
+	Schema json.RawMessage `json:"schema"`
+	// Proto the prototype of the version
+	Proto json.RawMessage `json:"proto,omitempty"`
+	// Created when the version was created
+	Created time.Time `json:"created"`
+	// Items the number of items of the type last validated against the version
+	Items int `json:"items"`
+}
+
+// setType sets the schema and prototype of an item type, checking the new schema is compatible with the current one
+// under the specified mode; returns the breaking changes found along with ErrIncompatibleSchema unless forced
+func setType(s Store, key string, schema, proto []byte, mode string, force bool) ([]string, error) {
+	next, err := decodeSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	var breaking []string
+	err = s.setCheckedType(key, schema, proto, func(current []byte) error {
+		if breaking, err = compareSchemas(key, current, next, mode); err != nil {
+			return err
+		}
+		if len(breaking) > 0 && !force {
+			return ErrIncompatibleSchema
+		}
+		return nil
+	})
+	return breaking, err
+}
+
+// schemaChanges the breaking changes from the current schema of an item type, if any, to a new schema under a mode
+func schemaChanges(s Store, key string, schema []byte, mode string) ([]string, error) {
+	next, err := decodeSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.getTypeInfo(key)
+	if err == ErrItemTypeNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compareSchemas(key, current.Schema, next, mode)
+}
+
+// decodeSchema decodes a json schema, checking it is valid
+func decodeSchema(schema []byte) (interface{}, error) {
+	doc, err := decodeJson(schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	if err = json.Unmarshal(schema, &schemaValidation.Schema{}); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	return doc, nil
+}
+
+// compareSchemas the breaking changes from the current schema of an item type, nil for a new type, to a decoded schema
+// under a mode
+func compareSchemas(key string, current []byte, next interface{}, mode string) ([]string, error) {
+	if current == nil {
+		return nil, nil
+	}
+	prev, err := decodeJson(current)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode current schema of type %s: %s", key, err)
+	}
+	return checkCompatibility(prev, next, mode), nil
+}
+
+// sameSchema true if two json schemas are written the same, ignoring insignificant whitespace
+func sameSchema(a, b []byte) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// checkCompatibility the breaking changes from the current to the new version of a decoded schema under a mode
+func checkCompatibility(current, next interface{}, mode string) []string {
+	var breaking []string
+	if mode == compatBackward || mode == compatFull {
+		for _, c := range newSchemaChecker(current, next).narrowed(current, next, nil) {
+			breaking = append(breaking, "backward: "+c)
+		}
+	}
+	if mode == compatForward || mode == compatFull {
+		for _, c := range newSchemaChecker(next, current).narrowed(next, current, nil) {
+			breaking = append(breaking, "forward: "+c)
+		}
+	}
+	return breaking
+}
+
+// uncheckedKeywords the schema keywords whose effect is not compared, they can be removed but not added or changed
+var uncheckedKeywords = []string{
+	"$ref", "allOf", "anyOf", "oneOf", "not", "if", "then", "else", "format", "pattern", "multipleOf", "uniqueItems",
+	"contains", "propertyNames", "patternProperties", "dependencies", "dependentRequired", "dependentSchemas",
+}
+
+// schemaChecker finds the values accepted by a schema that another schema rejects, conservatively: changes it cannot
+// compare are reported as breaking
+type schemaChecker struct {
+	// fromRoot and toRoot the documents local references of each schema are resolved against
+	fromRoot, toRoot interface{}
+	// seen the pairs of references compared, as recursive schemas would be compared endlessly
+	seen map[string]bool
+}
+
+func newSchemaChecker(fromRoot, toRoot interface{}) *schemaChecker {
+	return &schemaChecker{fromRoot: fromRoot, toRoot: toRoot, seen: map[string]bool{}}
+}
+
+// narrowed describes the values at a path that the from schema accepts and the to schema rejects
+func (c *schemaChecker) narrowed(from, to interface{}, path []string) []string {
+	from, fromRef := resolveSchemaRef(c.fromRoot, from)
+	to, toRef := resolveSchemaRef(c.toRoot, to)
+	if len(fromRef) > 0 || len(toRef) > 0 {
+		pair := fromRef + " " + toRef
+		if c.seen[pair] {
+			return nil
+		}
+		c.seen[pair] = true
+	}
+	// boolean schemas accept either everything or nothing
+	if accepts, ok := to.(bool); ok {
+		if accepts || from == false {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: no longer accepts any value", location(path))}
+	}
+	if from == false {
+		return nil
+	}
+	f, _ := from.(map[string]interface{})
+	t, ok := to.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if f == nil {
+		f = map[string]interface{}{}
+	}
+	var out []string
+	report := func(format string, args ...interface{}) {
+		out = append(out, location(path)+": "+fmt.Sprintf(format, args...))
+	}
+	for _, k := range uncheckedKeywords {
+		if v, found := t[k]; found {
+			if old, had := f[k]; !had || !jsonEqual(old, v) {
+				report("'%s' added or changed", k)
+			}
+		}
+	}
+	// types
+	fromTypes := schemaTypes(f)
+	if toTypes := schemaTypes(t); toTypes != nil {
+		if fromTypes == nil {
+			report("type restricted to %s", strings.Join(toTypes, ", "))
+		} else {
+			for _, ft := range fromTypes {
+				if !contains(toTypes, ft) && !(ft == "integer" && contains(toTypes, "number")) {
+					report("type %s no longer accepted", ft)
+				}
+			}
+		}
+	}
+	// allowed values
+	if v, found := t["const"]; found {
+		if old, had := f["const"]; !had || !jsonEqual(old, v) {
+			report("value restricted to %s", jsonString(v))
+		}
+	}
+	if values, found := t["enum"].([]interface{}); found {
+		if old, had := f["const"]; had {
+			if !containsJson(values, old) {
+				report("value %s no longer accepted", jsonString(old))
+			}
+		} else if oldValues, had := f["enum"].([]interface{}); had {
+			for _, v := range oldValues {
+				if !containsJson(values, v) {
+					report("value %s no longer accepted", jsonString(v))
+				}
+			}
+		} else {
+			report("values restricted to %s", jsonString(values))
+		}
+	}
+	// bounds
+	for _, k := range []string{"minimum", "exclusiveMinimum", "minLength", "minItems", "minProperties"} {
+		if change := boundChange(f[k], t[k], true); len(change) > 0 {
+			report("%s %s", k, change)
+		}
+	}
+	for _, k := range []string{"maximum", "exclusiveMaximum", "maxLength", "maxItems", "maxProperties"} {
+		if change := boundChange(f[k], t[k], false); len(change) > 0 {
+			report("%s %s", k, change)
+		}
+	}
+	// object members
+	fromRequired, toRequired := stringList(f["required"]), stringList(t["required"])
+	for _, r := range toRequired {
+		if !contains(fromRequired, r) {
+			out = append(out, fmt.Sprintf("%s: now required", location(append(append([]string{}, path...), r))))
+		}
+	}
+	fromProps, _ := f["properties"].(map[string]interface{})
+	toProps, _ := t["properties"].(map[string]interface{})
+	names := map[string]bool{}
+	for name := range fromProps {
+		names[name] = true
+	}
+	for name := range toProps {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		fp, found := fromProps[name]
+		if !found {
+			fp = additionalSchema(f, "additionalProperties")
+		}
+		tp, found := toProps[name]
+		if !found {
+			tp = additionalSchema(t, "additionalProperties")
+		}
+		out = append(out, c.narrowed(fp, tp, append(append([]string{}, path...), name))...)
+	}
+	out = append(out, c.narrowed(additionalSchema(f, "additionalProperties"), additionalSchema(t, "additionalProperties"), append(append([]string{}, path...), "*"))...)
+	// array elements, only single schemas are compared
+	if _, tuple := t["items"].([]interface{}); tuple {
+		if old, had := f["items"]; !had || !jsonEqual(old, t["items"]) {
+			report("'items' added or changed")
+		}
+	} else if _, found := t["items"]; found {
+		fi := additionalSchema(f, "items")
+		if _, tuple = fi.([]interface{}); tuple {
+			report("'items' changed")
+		} else {
+			out = append(out, c.narrowed(fi, t["items"], append(append([]string{}, path...), "*"))...)
+		}
+	}
+	return out
+}
+
+// resolveSchemaRef follows the local references of a schema, returning the schema referred to and the reference
+// followed; references to other documents are left as they are
+func resolveSchemaRef(root, schema interface{}) (interface{}, string) {
+	var ref string
+	for i := 0; i < maxRefDepth; i++ {
+		s, ok := schema.(map[string]interface{})
+		if !ok {
+			break
+		}
+		r, ok := s["$ref"].(string)
+		if !ok || !strings.HasPrefix(r, "#") {
+			break
+		}
+		path, err := parsePointer(r[1:])
+		if err != nil {
+			break
+		}
+		target, found := resolvePath(root, path)
+		if !found {
+			break
+		}
+		schema, ref = target, r
+	}
+	return schema, ref
+}
+
+// schemaTypes the types a schema accepts, nil if it does not restrict them
+func schemaTypes(schema map[string]interface{}) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		return stringList(t)
+	}
+	return nil
+}
+
+// additionalSchema the schema of a keyword applying to members or elements, which accepts anything if not specified
+func additionalSchema(schema map[string]interface{}, keyword string) interface{} {
+	if s, found := schema[keyword]; found {
+		return s
+	}
+	return true
+}
+
+// boundChange describes how a lower or upper bound was tightened, empty if it was not
+func boundChange(from, to interface{}, lower bool) string {
+	t, ok := number(to)
+	if !ok {
+		return ""
+	}
+	f, ok := number(from)
+	if !ok {
+		return fmt.Sprintf("%v added", to)
+	}
+	if lower && t > f {
+		return fmt.Sprintf("raised from %v to %v", from, to)
+	}
+	if !lower && t < f {
+		return fmt.Sprintf("lowered from %v to %v", from, to)
+	}
+	return ""
+}
+
+// number the value of a decoded json number
+func number(v interface{}) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// stringList the strings in a decoded json array
+func stringList(v interface{}) []string {
+	values, _ := v.([]interface{})
+	var list []string
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// jsonString a decoded json value written as json
+func jsonString(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// location the JSON Pointer to a value described in messages
+func location(path []string) string {
+	if len(path) == 0 {
+		return "root"
+	}
+	return pointerString(path)
+}
@@ -0,0 +1,169 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCheckCompatibility(t *testing.T) {
+	cases := []struct {
+		name, current, next, mode, breaking string
+	}{
+		{
+			name:    "optional property added to closed object",
+			current: `{"type":"object","properties":{"a":{"type":"string"}},"additionalProperties":false}`,
+			next:    `{"type":"object","properties":{"a":{"type":"string"},"b":{"type":"integer"}},"additionalProperties":false}`,
+			mode:    compatBackward,
+		},
+		{
+			name:     "optional property added to closed object, forward",
+			current:  `{"type":"object","properties":{"a":{"type":"string"}},"additionalProperties":false}`,
+			next:     `{"type":"object","properties":{"a":{"type":"string"},"b":{"type":"integer"}},"additionalProperties":false}`,
+			mode:     compatForward,
+			breaking: "[forward: /b: no longer accepts any value]",
+		},
+		{
+			name:     "property required and narrowed",
+			current:  `{"type":"object","properties":{"port":{"type":"number","minimum":1}}}`,
+			next:     `{"type":"object","required":["port"],"properties":{"port":{"type":"integer","minimum":1024}}}`,
+			mode:     compatBackward,
+			breaking: "[backward: /port: now required backward: /port: type number no longer accepted backward: /port: minimum raised from 1 to 1024]",
+		},
+		{
+			name:    "constraints relaxed",
+			current: `{"type":"object","required":["port"],"properties":{"port":{"type":"integer","maximum":100},"mode":{"enum":["a","b"]}}}`,
+			next:    `{"type":["object","null"],"properties":{"port":{"type":"number"},"mode":{"enum":["a","b","c"]}}}`,
+			mode:    compatBackward,
+		},
+		{
+			name:     "constraints relaxed, full",
+			current:  `{"type":"object","properties":{"mode":{"enum":["a","b"]}}}`,
+			next:     `{"type":"object","properties":{"mode":{"enum":["a","b","c"]}}}`,
+			mode:     compatFull,
+			breaking: `[forward: /mode: value "c" no longer accepted]`,
+		},
+		{
+			name:     "array elements and references",
+			current:  `{"$ref":"#/$defs/list","$defs":{"list":{"type":"array","items":{"type":"string"}}}}`,
+			next:     `{"$ref":"#/$defs/list","$defs":{"list":{"type":"array","items":{"type":"string","maxLength":10}}}}`,
+			mode:     compatBackward,
+			breaking: "[backward: /*: maxLength 10 added]",
+		},
+		{
+			name:     "recursive schema",
+			current:  `{"$ref":"#/$defs/node","$defs":{"node":{"type":"object","properties":{"children":{"type":"array","items":{"$ref":"#/$defs/node"}}}}}}`,
+			next:     `{"$ref":"#/$defs/node","$defs":{"node":{"type":"object","properties":{"name":{"type":"string"},"children":{"type":"array","items":{"$ref":"#/$defs/node"}}}}}}`,
+			mode:     compatBackward,
+			breaking: "[backward: /name: type restricted to string]",
+		},
+		{
+			name:     "unchecked keyword added",
+			current:  `{"type":"string"}`,
+			next:     `{"type":"string","pattern":"^a"}`,
+			mode:     compatBackward,
+			breaking: "[backward: root: 'pattern' added or changed]",
+		},
+		{
+			name:    "no check",
+			current: `{"type":"string"}`,
+			next:    `{"type":"integer"}`,
+			mode:    compatNone,
+		},
+	}
+	for _, c := range cases {
+		current, err := decodeJson([]byte(c.current))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		next, err := decodeJson([]byte(c.next))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		breaking := checkCompatibility(current, next, c.mode)
+		if len(c.breaking) == 0 && len(breaking) > 0 || len(c.breaking) > 0 && fmt.Sprint(breaking) != c.breaking {
+			t.Fatalf("%s: expected %s, got %v", c.name, c.breaking, breaking)
+		}
+	}
+}
+
+func TestTypeVersions(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			v1 := []byte(`{"type":"object","properties":{"port":{"type":"integer"}}}`)
+			if _, err := setType(s, "db", v1, []byte(`{"port":1}`), compatBackward, false); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if err, _ := s.SetItem("db1", "db", `{"port":5432}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			// the same schema only updates the prototype
+			if _, err := setType(s, "db", []byte(`{"type": "object", "properties": {"port": {"type": "integer"}}}`), []byte(`{"port":2}`), compatBackward, false); err != nil {
+				t.Fatalf(err.Error())
+			}
+			// a breaking change is rejected unless forced
+			v2 := []byte(`{"type":"object","required":["host"],"properties":{"port":{"type":"integer"},"host":{"type":"string"}}}`)
+			breaking, err := setType(s, "db", v2, []byte(`{}`), compatBackward, false)
+			if err != ErrIncompatibleSchema || fmt.Sprint(breaking) != "[backward: /host: now required backward: /host: type restricted to string]" {
+				t.Fatalf("expected incompatible schema, got %v %v", err, breaking)
+			}
+			if breaking, err = setType(s, "db", v2, []byte(`{}`), compatNone, false); err != nil || len(breaking) > 0 {
+				t.Fatalf("expected no check, got %v %v", err, breaking)
+			}
+			if err, _ = s.SetItem("db2", "db", `{"host":"h","port":5432}`, 0); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if _, err = setType(s, "db", []byte(`{"type":`), nil, compatBackward, false); !errors.Is(err, ErrInvalidSchema) {
+				t.Fatalf("expected invalid schema, got %v", err)
+			}
+			// the check is made against the schema current when the type is set
+			var checked []byte
+			err = s.setCheckedType("db", v1, []byte(`{}`), func(current []byte) error {
+				checked = current
+				return ErrIncompatibleSchema
+			})
+			if err != ErrIncompatibleSchema || !sameSchema(checked, v2) {
+				t.Fatalf("expected the check of %s to fail, got %v checking %s", v2, err, checked)
+			}
+			versions, err := s.getTypeVersions("db")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			var summary []string
+			for _, v := range versions {
+				summary = append(summary, fmt.Sprintf("%d:%d:%s", v.Version, v.Items, v.Proto))
+			}
+			if fmt.Sprint(summary) != `[2:1:{} 1:1:{"port":2}]` {
+				t.Fatalf("unexpected versions %v", summary)
+			}
+			v, err := s.getTypeVersion("db", 1)
+			if err != nil || !sameSchema(v.Schema, v1) {
+				t.Fatalf("unexpected version 1 %v %v", v, err)
+			}
+			if _, err = s.getTypeVersion("db", 3); err != ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+			// versions continue when a type is set again after being deleted
+			if err = s.DeleteType("db"); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if _, err = setType(s, "db", v1, []byte(`{}`), compatBackward, false); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if versions, err = s.getTypeVersions("db"); err != nil || versions[0].Version != 3 {
+				t.Fatalf("expected version 3, got %v %v", versions, err)
+			}
+			if _, err = s.getTypeVersions("missing"); err != ErrItemTypeNotFound {
+				t.Fatalf("expected type not found, got %v", err)
+			}
+		})
+	}
+}
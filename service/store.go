@@ -0,0 +1,168 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	schemaValidation "github.com/qri-io/jsonschema"
+	"southwinds.dev/source_client"
+	"time"
+)
+
+// Store the storage backend for configuration items, types, tags and links
+type Store interface {
+	// setTypeFromString set the json schema and prototype for an item type, recording a new version if the schema changes
+	setTypeFromString(key string, schema, proto []byte) error
+	// setCheckedType set the json schema and prototype for an item type if a check of the current schema, nil for a new
+	// type, passes; the check is made in the same transaction the type is set in
+	setCheckedType(key string, schema, proto []byte, check func(current []byte) error) error
+	// setTypeRetention set the number of revisions kept for items of a type
+	setTypeRetention(key string, retention int) error
+	// getTypeInfo get an item type
+	getTypeInfo(key string) (*src.TT, error)
+	// getTypes get all item types
+	getTypes() ([]src.TT, error)
+	// getTypeVersions get the versions of the schema of an item type, newest first
+	getTypeVersions(key string) ([]TypeVersion, error)
+	// getTypeVersion get a version of the schema of an item type
+	getTypeVersion(key string, version int64) (*TypeVersion, error)
+	// DeleteType delete an item type
+	DeleteType(key string) error
+
+	// SetItem set the value of an item, see DataBase.SetItem for the meaning of version
+	SetItem(key, iType string, value interface{}, version int64) (error, bool)
+	// getItem get an item by key
+	getItem(key string) (*src.I, error)
+	// getVersionedItem get an item by key along with its current version
+	getVersionedItem(key string) (*src.I, int64, error)
+	// getItemStamp get the version and last update time of an item
+	getItemStamp(key string) (int64, time.Time, error)
+	// getItems get all items
+	getItems() ([]src.I, error)
+	// getItemTypes get the type of all items by key, without reading their values
+	getItemTypes() (map[string]string, error)
+	// getItemsStamp get an entity tag and the last modification time for all items
+	getItemsStamp() (string, time.Time, error)
+	// getItemsByType get the items of a type
+	getItemsByType(t string) ([]src.I, error)
+	// getItemTypeVersions get the version of the type schema the items of a type were last validated against, by
+	// item key, for the items whose version is known
+	getItemTypeVersions(t string) (map[string]int64, error)
+	// getFilterCandidates get the items of a type, or all items if no type is specified, that may satisfy a filter
+	getFilterCandidates(t string, f valueFilter) ([]src.I, error)
+	// getItemsByTypeStamp get an entity tag and the last modification time for the items of a type
+	getItemsByTypeStamp(t string) (string, time.Time, error)
+	// DeleteItem delete an item, see DataBase.DeleteItem for the meaning of version
+	DeleteItem(key string, version int64, opts deleteOptions) error
+	// popOldestByType get and remove the oldest item of a type
+	popOldestByType(itemType string) (*src.I, error)
+	// popNewestByType get and remove the newest item of a type
+	popNewestByType(itemType string) (*src.I, error)
+
+	// getItemHistory get the revisions kept for an item, newest first
+	getItemHistory(key string) ([]Revision, error)
+	// getItemRevision get a specific revision of an item
+	getItemRevision(key string, revision int64) (*Revision, error)
+
+	// tag an item with a name only
+	tag(key, name string) error
+	// tagValue tag an item with a name and a value
+	tagValue(key, name, value string) error
+	// untag remove a tag from an item
+	untag(key string, name string) error
+	// getTags get the tags of an item
+	getTags(key string) ([]src.T, error)
+	// getAllTags get the tags of all items
+	getAllTags() ([]src.T, error)
+	// getTaggedItems get the items having any of the specified tag names
+	getTaggedItems(tags ...string) ([]src.I, error)
+	// getItemsByTags get the items matching a tag expression
+	getItemsByTags(expr tagExpr) ([]src.I, error)
+
+	// Link add an association of a kind between two items, or replace its attributes if it exists, both items must exist
+	Link(from, to, rel string, attributes json.RawMessage) error
+	// unLink remove an association of a kind between two items, or all their associations if no kind is specified
+	unLink(from, to, rel string) error
+	// getLinks get all associations, optionally of a kind only
+	getLinks(rel string) ([]Link, error)
+	// deleteLinks remove all associations
+	deleteLinks() error
+	// getChildren get the items linked from an item, optionally by associations of a kind only
+	getChildren(parentKey, rel string) ([]src.I, error)
+	// getParents get the items linking to an item, optionally by associations of a kind only
+	getParents(childKey, rel string) ([]src.I, error)
+	// getGraph get the descendants or ancestors of an item following links of the specified kinds up to a depth, zero
+	// meaning no limit
+	getGraph(key string, ancestors bool, depth int, kinds linkKinds) (*Graph, error)
+}
+
+var (
+	_ Store = (*DataBase)(nil)
+	_ Store = (*memStore)(nil)
+)
+
+// schemaInspector implemented by stores having a versioned database schema
+type schemaInspector interface {
+	schemaInfo() (*SchemaInfo, error)
+}
+
+// prepareItem turns the value of an item into a string and validates it against the schema of its type, if any
+// returns the value, the item type and any error along with a flag indicating if the error was a validation error
+func prepareItem(s Store, key, iType string, value interface{}) (string, *src.TT, error, bool) {
+	if value == nil {
+		return "", nil, fmt.Errorf("value not provided"), false
+	}
+	var typeInfo *src.TT
+	var err error
+	if len(iType) > 0 {
+		// get the schema for the type
+		typeInfo, err = s.getTypeInfo(iType)
+		if err != nil {
+			if err == ErrItemTypeNotFound {
+				return "", nil, err, false
+			} else {
+				return "", nil, fmt.Errorf("error retrieving type definition for %s: %s", key, err), false
+			}
+		}
+	}
+	sv, ok := value.(string)
+	if !ok {
+		valueBytes, err := json.Marshal(value)
+		if err != nil {
+			return "", nil, err, false
+		}
+		sv = string(valueBytes[:])
+	}
+	if err, isValidationError := validate(sv, typeInfo); err != nil {
+		return "", nil, err, isValidationError
+	}
+	return sv, typeInfo, nil, false
+}
+
+// validate an item value using the schema of its type, only performs validation if a type is specified
+// validation errors are returned as ValidationErrors, listing all the errors found
+func validate(value string, iType *src.TT) (error, bool) {
+	if iType == nil {
+		return nil, false
+	}
+	rs := &schemaValidation.Schema{}
+	if err := json.Unmarshal(iType.Schema, rs); err != nil {
+		return fmt.Errorf("unmarshal schema: %s", err), false
+	}
+	secrets, err := secretPaths(iType.Schema)
+	if err != nil {
+		return err, false
+	}
+	// validate the value using the stored schema
+	if errs := validationErrors(rs, secrets, []byte(value)); len(errs) > 0 {
+		return &ValidationErrors{Errors: errs}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,291 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tagExpr a boolean expression over the tags of an item, for example:
+//
+//	env=prod AND (team=payments OR critical) AND NOT deprecated
+//
+// a tag name on its own matches items having the tag whatever its value, name=value matches items having the tag
+// with that value; names and values containing spaces, parentheses or equal signs can be double-quoted
+type tagExpr interface {
+	// where the sql condition selecting the items of the query aliased as i matching the expression, appending the
+	// values of its placeholders to args
+	where(args *[]interface{}) string
+	// match true if an item having the specified tag names and values matches the expression
+	match(tags map[string]string) bool
+	String() string
+}
+
+// tagTerm matches items having a tag, optionally with a specific value
+type tagTerm struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+func (t *tagTerm) where(args *[]interface{}) string {
+	*args = append(*args, t.name)
+	if !t.hasValue {
+		return "EXISTS (SELECT 1 FROM tag t WHERE t.item_key = i.key AND t.name = ?)"
+	}
+	*args = append(*args, t.value)
+	return "EXISTS (SELECT 1 FROM tag t WHERE t.item_key = i.key AND t.name = ? AND t.value = ?)"
+}
+
+func (t *tagTerm) match(tags map[string]string) bool {
+	value, ok := tags[t.name]
+	return ok && (!t.hasValue || value == t.value)
+}
+
+func (t *tagTerm) String() string {
+	if t.hasValue {
+		return fmt.Sprintf("%q=%q", t.name, t.value)
+	}
+	return fmt.Sprintf("%q", t.name)
+}
+
+type tagNot struct {
+	expr tagExpr
+}
+
+func (n *tagNot) where(args *[]interface{}) string {
+	return "NOT " + n.expr.where(args)
+}
+
+func (n *tagNot) match(tags map[string]string) bool {
+	return !n.expr.match(tags)
+}
+
+func (n *tagNot) String() string {
+	return "NOT " + n.expr.String()
+}
+
+// tagBinary a conjunction (AND) or disjunction (OR) of two expressions
+type tagBinary struct {
+	and         bool
+	left, right tagExpr
+}
+
+func (b *tagBinary) operator() string {
+	if b.and {
+		return "AND"
+	}
+	return "OR"
+}
+
+func (b *tagBinary) where(args *[]interface{}) string {
+	left := b.left.where(args)
+	right := b.right.where(args)
+	return fmt.Sprintf("(%s %s %s)", left, b.operator(), right)
+}
+
+func (b *tagBinary) match(tags map[string]string) bool {
+	if b.and {
+		return b.left.match(tags) && b.right.match(tags)
+	}
+	return b.left.match(tags) || b.right.match(tags)
+}
+
+func (b *tagBinary) String() string {
+	return fmt.Sprintf("(%s %s %s)", b.left, b.operator(), b.right)
+}
+
+// tagToken a lexical element of a tag expression
+type tagToken struct {
+	// kind one of word, string, (, ), =, AND, OR, NOT or end
+	kind  string
+	text  string
+	where int
+}
+
+// lexTagExpr splits a tag expression into tokens
+func lexTagExpr(s string) ([]tagToken, error) {
+	var tokens []tagToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')' || c == '=':
+			tokens = append(tokens, tagToken{kind: string(c), text: string(c), where: i})
+			i++
+		case c == '"':
+			start := i
+			var text strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start+1)
+			}
+			i++
+			tokens = append(tokens, tagToken{kind: "string", text: text.String(), where: start})
+		default:
+			start := i
+			for ; i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()="`, runes[i]); i++ {
+			}
+			word := string(runes[start:i])
+			kind := "word"
+			if op := strings.ToUpper(word); op == "AND" || op == "OR" || op == "NOT" {
+				kind = op
+			}
+			tokens = append(tokens, tagToken{kind: kind, text: word, where: start})
+		}
+	}
+	return append(tokens, tagToken{kind: "end", where: len(runes)}), nil
+}
+
+// tagParser a recursive descent parser for tag expressions, NOT binds tighter than AND which binds tighter than OR
+type tagParser struct {
+	tokens []tagToken
+	pos    int
+	// depth the nesting level of parentheses and negations, limited to bound the size of the generated sql
+	depth int
+	// terms the number of tag terms parsed, limited as well as each one adds a subquery to the generated sql
+	terms int
+}
+
+const (
+	// maxTagExprDepth the maximum nesting of a tag expression
+	maxTagExprDepth = 32
+	// maxTagExprTerms the maximum number of tag terms in a tag expression
+	maxTagExprTerms = 64
+)
+
+// parseTagExpr parses a tag expression
+func parseTagExpr(s string) (tagExpr, error) {
+	tokens, err := lexTagExpr(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag expression: %s", err)
+	}
+	p := &tagParser{tokens: tokens}
+	expr, err := p.or()
+	if err == nil && p.peek().kind != "end" {
+		err = p.unexpected()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid tag expression: %s", err)
+	}
+	return expr, nil
+}
+
+func (p *tagParser) peek() tagToken {
+	return p.tokens[p.pos]
+}
+
+func (p *tagParser) next() tagToken {
+	t := p.tokens[p.pos]
+	if t.kind != "end" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *tagParser) unexpected() error {
+	t := p.peek()
+	if t.kind == "end" {
+		return fmt.Errorf("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected '%s' at position %d", t.text, t.where+1)
+}
+
+func (p *tagParser) or() (tagExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "OR" {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagBinary{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) and() (tagExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "AND" {
+		p.next()
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &tagBinary{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) not() (tagExpr, error) {
+	if p.peek().kind != "NOT" {
+		return p.primary()
+	}
+	p.next()
+	if p.depth++; p.depth > maxTagExprDepth {
+		return nil, fmt.Errorf("expression nested too deeply")
+	}
+	defer func() { p.depth-- }()
+	expr, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	return &tagNot{expr: expr}, nil
+}
+
+func (p *tagParser) primary() (tagExpr, error) {
+	switch p.peek().kind {
+	case "(":
+		p.next()
+		if p.depth++; p.depth > maxTagExprDepth {
+			return nil, fmt.Errorf("expression nested too deeply")
+		}
+		defer func() { p.depth-- }()
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != ")" {
+			return nil, p.unexpected()
+		}
+		p.next()
+		return expr, nil
+	case "word", "string":
+		if p.terms++; p.terms > maxTagExprTerms {
+			return nil, fmt.Errorf("expression has more than %d terms", maxTagExprTerms)
+		}
+		name := p.next().text
+		if p.peek().kind != "=" {
+			return &tagTerm{name: name}, nil
+		}
+		p.next()
+		if k := p.peek().kind; k != "word" && k != "string" {
+			return nil, p.unexpected()
+		}
+		return &tagTerm{name: name, value: p.next().text, hasValue: true}, nil
+	default:
+		return nil, p.unexpected()
+	}
+}
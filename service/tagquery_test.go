@@ -0,0 +1,95 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTagExpr(t *testing.T) {
+	valid := map[string]string{
+		`critical`:                    `"critical"`,
+		`env=prod and not deprecated`: `("env"="prod" AND NOT "deprecated")`,
+		`a OR b AND c`:                `("a" OR ("b" AND "c"))`,
+		`(a OR b) AND c`:              `(("a" OR "b") AND "c")`,
+		`"team name"="pay ments"`:     `"team name"="pay ments"`,
+	}
+	for input, expected := range valid {
+		expr, err := parseTagExpr(input)
+		if err != nil {
+			t.Fatalf("cannot parse %s: %s", input, err)
+		}
+		if expr.String() != expected {
+			t.Fatalf("parsing %s: expected %s, got %s", input, expected, expr)
+		}
+	}
+	for _, input := range []string{``, `AND`, `a AND`, `(a`, `a)`, `=b`, `a=`, `"a`, `a b`, strings.Repeat("(", 40) + "a" + strings.Repeat(")", 40), "a" + strings.Repeat(" OR a", 64)} {
+		if _, err := parseTagExpr(input); err == nil {
+			t.Fatalf("expected %q to be rejected", input)
+		}
+	}
+}
+
+func TestTagQuery(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			tags := map[string]map[string]string{
+				"pay-prod":   {"env": "prod", "team": "payments"},
+				"pay-dev":    {"env": "dev", "team": "payments"},
+				"core-prod":  {"env": "prod", "team": "core", "critical": ""},
+				"old-prod":   {"env": "prod", "team": "payments", "deprecated": ""},
+				"injection'": {"env": "x' OR '1'='1"},
+			}
+			for key, itemTags := range tags {
+				if err, _ := s.SetItem(key, "", `{}`, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+				for n, v := range itemTags {
+					if err := s.tagValue(key, n, v); err != nil {
+						t.Fatalf(err.Error())
+					}
+				}
+			}
+			cases := map[string]string{
+				`env=prod AND (team=payments OR critical) AND NOT deprecated`: "core-prod,pay-prod",
+				`team=payments`:          "old-prod,pay-dev,pay-prod",
+				`NOT env=prod`:           "injection',pay-dev",
+				`env="x' OR '1'='1"`:     "injection'",
+				`env="x' OR 1=1 --"`:     "",
+				`critical OR deprecated`: "core-prod,old-prod",
+			}
+			for query, expected := range cases {
+				expr, err := parseTagExpr(query)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				items, err := s.getItemsByTags(expr)
+				if err != nil {
+					t.Fatalf(err.Error())
+				}
+				var keys []string
+				for _, i := range items {
+					keys = append(keys, i.Key)
+				}
+				if strings.Join(keys, ",") != expected {
+					t.Fatalf("query %s: expected %s, got %s", query, expected, strings.Join(keys, ","))
+				}
+			}
+			// the legacy tag name lookup is parameterised too
+			items, err := s.getTaggedItems("critical", "x') OR ('1'='1")
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(items) != 1 || items[0].Key != "core-prod" {
+				t.Fatalf("unexpected tagged items %v", items)
+			}
+		})
+	}
+}
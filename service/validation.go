@@ -0,0 +1,226 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	schemaValidation "github.com/qri-io/jsonschema"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ValidationReport the result of validating the items of a type against a schema
+type ValidationReport struct {
+	// Type the key of the item type
+	Type string `json:"type"`
+	// Version the version of the type schema the items were validated against, zero for a schema not yet set
+	Version int64 `json:"version,omitempty"`
+	// Breaking the breaking changes from the current schema, for a schema not yet set
+	Breaking []string `json:"breaking,omitempty"`
+	// Checked the number of items validated
+	Checked int `json:"checked"`
+	// Failed the items not valid against the schema, by key
+	Failed []ItemValidation `json:"failed"`
+}
+
+// ItemValidation the errors found validating an item
+type ItemValidation struct {
+	// Key the key of the item
+	Key string `json:"key"`
+	// TypeVersion the version of the type schema the item was last validated against, zero if not known
+	TypeVersion int64 `json:"typeVersion,omitempty"`
+	// Errors the validation errors
+	Errors []ValidationError `json:"errors"`
+}
+
+// validateItems validates the items of a type against the current schema of the type
+func validateItems(s Store, key string) (*ValidationReport, error) {
+	typeInfo, err := s.getTypeInfo(key)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.getTypeVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	report, err := validateItemsAgainst(s, key, typeInfo.Schema)
+	if err != nil {
+		return nil, err
+	}
+	report.Version = versions[0].Version
+	return report, nil
+}
+
+// previewType the breaking changes and the items that would fail validation if a schema was set for a type
+func previewType(s Store, key string, schema []byte, mode string) (*ValidationReport, error) {
+	breaking, err := schemaChanges(s, key, schema, mode)
+	if err != nil {
+		return nil, err
+	}
+	report, err := validateItemsAgainst(s, key, schema)
+	if err != nil {
+		return nil, err
+	}
+	report.Breaking = breaking
+	return report, nil
+}
+
+// validateItemsAgainst validates the items of a type against a schema
+func validateItemsAgainst(s Store, key string, schema []byte) (*ValidationReport, error) {
+	rs := &schemaValidation.Schema{}
+	if err := json.Unmarshal(schema, rs); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err)
+	}
+	items, err := s.getItemsByType(key)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := secretPaths(schema)
+	if err != nil {
+		return nil, err
+	}
+	typeVersions, err := s.getItemTypeVersions(key)
+	if err != nil {
+		return nil, err
+	}
+	report := &ValidationReport{Type: key, Checked: len(items), Failed: []ItemValidation{}}
+	for _, item := range items {
+		if errs := validationErrors(rs, secrets, item.Value); len(errs) > 0 {
+			report.Failed = append(report.Failed, ItemValidation{Key: item.Key, TypeVersion: typeVersions[item.Key], Errors: errs})
+		}
+	}
+	sort.Slice(report.Failed, func(i, j int) bool { return report.Failed[i].Key < report.Failed[j].Key })
+	return report, nil
+}
+
+// ValidationError an error found validating a value against a json schema
+type ValidationError struct {
+	// Pointer the JSON Pointer to the value in error, empty for the whole value
+	Pointer string `json:"pointer"`
+	// Keyword the schema keyword the value does not satisfy, empty if not known
+	Keyword string `json:"keyword,omitempty"`
+	// Message the description of the error
+	Message string `json:"message"`
+}
+
+// ValidationErrors the errors found validating an item value against the schema of its type
+type ValidationErrors struct {
+	Errors []ValidationError
+}
+
+func (e *ValidationErrors) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Message
+		if len(err.Pointer) > 0 {
+			messages[i] = err.Pointer + ": " + err.Message
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) Unwrap() error {
+	return ErrInvalidItemValue
+}
+
+// errorKeywords the schema keywords reported by the messages of the validator, which does not record them
+var errorKeywords = []struct {
+	message *regexp.Regexp
+	keyword string
+}{
+	{regexp.MustCompile(`^type should be `), "type"},
+	{regexp.MustCompile(`^should be one of `), "enum"},
+	{regexp.MustCompile(`^must equal `), "const"},
+	{regexp.MustCompile(`^".*" value is required$`), "required"},
+	{regexp.MustCompile(`^".*" property is required$`), "dependentRequired"},
+	{regexp.MustCompile(`^additional properties are not allowed$`), "additionalProperties"},
+	{regexp.MustCompile(`^unevaluated properties are not allowed$`), "unevaluatedProperties"},
+	{regexp.MustCompile(`^\d+ object Properties exceed \d+ maximum$`), "maxProperties"},
+	{regexp.MustCompile(`^\d+ object Properties below \d+ minimum$`), "minProperties"},
+	{regexp.MustCompile(`^must be a multiple of `), "multipleOf"},
+	{regexp.MustCompile(`^must be less than or equal to `), "maximum"},
+	{regexp.MustCompile(`^must be greater than or equal to `), "minimum"},
+	{regexp.MustCompile(`^\S+ must be less than `), "exclusiveMaximum"},
+	{regexp.MustCompile(`^\S+ must be greater than `), "exclusiveMinimum"},
+	{regexp.MustCompile(`^max length of \d+ characters exceeded`), "maxLength"},
+	{regexp.MustCompile(`^min length of \d+ characters required`), "minLength"},
+	{regexp.MustCompile(`^regexp pattern `), "pattern"},
+	{regexp.MustCompile(`^invalid \S+: `), "format"},
+	{regexp.MustCompile(`^array length \d+ exceeds \d+ max$`), "maxItems"},
+	{regexp.MustCompile(`^array length \d+ below \d+ minimum items$`), "minItems"},
+	{regexp.MustCompile(`^array items must be unique`), "uniqueItems"},
+	{regexp.MustCompile(`^must contain at least one of`), "contains"},
+	{regexp.MustCompile(`^contained items \d+ exceeds `), "maxContains"},
+	{regexp.MustCompile(`^contained items \d+ bellow `), "minContains"},
+	{regexp.MustCompile(`^additional items are not allowed$`), "additionalItems"},
+	{regexp.MustCompile(`^unevaluated items are not allowed$`), "unevaluatedItems"},
+	{regexp.MustCompile(`(?i)^did not match any specified AnyOf schemas$`), "anyOf"},
+	{regexp.MustCompile(`OneOf schemas$`), "oneOf"},
+	{regexp.MustCompile(`^result was valid, \('not'\) expected invalid$`), "not"},
+	{regexp.MustCompile(`^failed to resolve schema for ref `), "$ref"},
+}
+
+// errorKeyword the schema keyword reported by a message of the validator, empty if not known
+func errorKeyword(message string) string {
+	for _, k := range errorKeywords {
+		if k.message.MatchString(message) {
+			return k.keyword
+		}
+	}
+	return ""
+}
+
+// validationErrors all the errors found validating a value against a schema, ordered by pointer, where the values of
+// the secret properties of the schema are masked
+func validationErrors(rs *schemaValidation.Schema, secrets [][]string, value []byte) []ValidationError {
+	keyErrs, err := rs.ValidateBytes(context.Background(), value)
+	if err != nil {
+		// the value is not valid json
+		return []ValidationError{{Message: err.Error()}}
+	}
+	doc, _ := decodeJson(value)
+	errs := make([]ValidationError, 0, len(keyErrs))
+	for _, e := range keyErrs {
+		message := e.Message
+		// the root of the value is reported as "/"
+		path, err := parsePointer(strings.TrimSuffix(e.PropertyPath, "/"))
+		for _, secret := range secrets {
+			if err == nil && pathWithin(path, secret) {
+				message = maskMessage(message, doc, path)
+				break
+			}
+		}
+		errs = append(errs, ValidationError{Pointer: pointerString(path), Keyword: errorKeyword(e.Message), Message: message})
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Pointer != errs[j].Pointer {
+			return errs[i].Pointer < errs[j].Pointer
+		}
+		return errs[i].Message < errs[j].Message
+	})
+	return errs
+}
+
+// maskMessage masks the value at a path of a document in an error message
+func maskMessage(message string, doc interface{}, path []string) string {
+	v, found := resolvePath(doc, path)
+	if !found {
+		return message
+	}
+	if str, ok := v.(string); ok {
+		if len(str) == 0 {
+			return message
+		}
+		return strings.ReplaceAll(message, str, secretMask)
+	}
+	return strings.ReplaceAll(message, jsonString(v), secretMask)
+}
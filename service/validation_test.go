@@ -0,0 +1,115 @@
+/*
+  Source Configuration Service
+  © 2022 Southwinds Tech Ltd - www.southwinds.io
+  Licensed under the Apache License, Version 2.0 at http://www.apache.org/licenses/LICENSE-2.0
+  Contributors to this project, hereby assign copyright in this code to the project,
+  to be licensed under the same terms as the rest of the code.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http/httptest"
+	"southwinds.dev/source_client"
+	"strings"
+	"testing"
+)
+
+func TestValidateItems(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			v1 := []byte(`{"type":"object","properties":{"port":{"type":"integer"},"password":{"type":"string","x-secret":true}}}`)
+			if err := s.setTypeFromString("db", v1, []byte(`{}`)); err != nil {
+				t.Fatalf(err.Error())
+			}
+			for key, value := range map[string]string{
+				"a": `{"port":5432,"host":"a"}`,
+				"b": `{"port":5432,"password":"s3cret"}`,
+				"c": `{}`,
+			} {
+				if err, _ := s.SetItem(key, "db", value, 0); err != nil {
+					t.Fatalf(err.Error())
+				}
+			}
+			v2 := []byte(`{"type":"object","required":["host"],"properties":{"port":{"type":"integer","minimum":8000},"host":{"type":"string"},"password":{"type":"string","minLength":8,"x-secret":true}}}`)
+			// a dry run reports the impact without setting the schema
+			report, err := previewType(s, "db", v2, compatBackward)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if len(report.Breaking) != 4 || report.Checked != 3 || report.Version != 0 {
+				t.Fatalf("unexpected preview %+v", report)
+			}
+			if fmt.Sprint(report.Failed) != `[{a 1 [{/port minimum must be greater than or equal to 8000}]} {b 1 [{ required "host" value is required} {/password minLength min length of 8 characters required: ********} {/port minimum must be greater than or equal to 8000}]} {c 1 [{ required "host" value is required}]}]` {
+				t.Fatalf("unexpected failures %v", report.Failed)
+			}
+			if report, err = validateItems(s, "db"); err != nil || report.Version != 1 || len(report.Failed) != 0 {
+				t.Fatalf("expected valid items, got %+v %v", report, err)
+			}
+			if _, err = setType(s, "db", v2, []byte(`{}`), compatBackward, true); err != nil {
+				t.Fatalf(err.Error())
+			}
+			if report, err = validateItems(s, "db"); err != nil || report.Version != 2 || len(report.Failed) != 3 {
+				t.Fatalf("expected failures against version 2, got %+v %v", report, err)
+			}
+			if _, err = validateItems(s, "missing"); err != ErrItemTypeNotFound {
+				t.Fatalf("expected type not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"required": ["name"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "pattern": "^[a-z]+$"},
+			"port": {"type": "integer", "maximum": 65535},
+			"mode": {"enum": ["a", "b"]},
+			"hosts": {"type": "array", "minItems": 1, "items": {"type": "string", "maxLength": 5}},
+			"token": {"type": "string", "minLength": 8, "x-secret": true}
+		}
+	}`)
+	err, isValidationError := validate(`{"port":70000,"mode":"c","hosts":["localhost",1],"token":"abc","other":true}`, &src.TT{Key: "app", Schema: schema})
+	var errs *ValidationErrors
+	if !isValidationError || !errors.As(err, &errs) || !errors.Is(err, ErrInvalidItemValue) {
+		t.Fatalf("expected validation errors, got %v", err)
+	}
+	var found []string
+	for _, e := range errs.Errors {
+		found = append(found, e.Pointer+" "+e.Keyword)
+		if strings.Contains(e.Message, "abc") {
+			t.Fatalf("secret value in error %v", e)
+		}
+	}
+	if fmt.Sprint(found) != "[ required  additionalProperties /hosts/0 maxLength /hosts/1 type /mode enum /port maximum /token minLength]" {
+		t.Fatalf("unexpected errors %v", errs.Errors)
+	}
+	if err, isValidationError = validate(`{"name":`, &src.TT{Key: "app", Schema: schema}); !isValidationError || !errors.As(err, &errs) || len(errs.Errors) != 1 {
+		t.Fatalf("expected a validation error for invalid json, got %v", err)
+	}
+}
+
+func TestSetItemValidationErrors(t *testing.T) {
+	UseStore(NewMemoryStore())
+	if err := db.setTypeFromString("app", []byte(`{"type":"object","required":["name"],"properties":{"port":{"type":"integer"}}}`), []byte(`{}`)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	r := mux.SetURLVars(httptest.NewRequest("PUT", "/item/a1", strings.NewReader(`{"port":"80"}`)), map[string]string{"key": "a1"})
+	r.Header.Set("Source-Type", "app")
+	w := httptest.NewRecorder()
+	SetItemHandler(w, r)
+	var body ValidationFailure
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != 400 {
+		t.Fatalf("expected a json validation failure, got %d %s", w.Code, w.Body.String())
+	}
+	if fmt.Sprint(body.Errors) != `[{ required "name" value is required} {/port type type should be integer, got string}]` {
+		t.Fatalf("unexpected errors %v", body.Errors)
+	}
+}